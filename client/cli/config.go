@@ -12,13 +12,13 @@ import (
 
 // 配置文件结构
 type config struct {
-	ServiceAdr string `mapstructure:"service_adr"` //服务器地址
-	UserName   string `mapstructure:"username"`    //用户名
-	Password   string `mapstructure:"password"`    //密码
-	ClientPort int    `mapstructure:"client_port"` //指定客户端端口号
-	DownRate   int    `mapstructure:"down_rate"`   //下载速度。为0时不限速，下同
-	UpRate     int    `mapstructure:"up_rate"`     //上传速度
-	token      string
+	ServiceAdr  string `mapstructure:"service_adr"`  //服务器地址
+	UserName    string `mapstructure:"username"`     //用户名
+	Password    string `mapstructure:"password"`     //密码
+	ClientPort  int    `mapstructure:"client_port"`  //指定客户端端口号
+	DownRate    int    `mapstructure:"down_rate"`    //下载速度。为0时不限速，下同
+	UpRate      int    `mapstructure:"up_rate"`      //上传速度
+	MetricsAddr string `mapstructure:"metrics_addr"` //监控指标/metrics的监听地址，和上传服务分开，为空时不提供
 }
 
 var cfg config
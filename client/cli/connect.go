@@ -1,53 +1,245 @@
 package cli
 
 import (
-	"github.com/gorilla/websocket"
+	"Gdown/protocol"
+	"errors"
 	"log"
 	"net/http"
+	"os"
 	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
 )
 
-var trueIpAdr string //客户端的真实IP地址，在传输已下载文件列表成功之后返回
+// 客户端的真实IP地址，在服务器回复welcome之后得到。心跳协程写，下载协程读
+var trueIpAdr struct {
+	mu sync.Mutex
+	ip string
+}
+
+// 服务器看到的本客户端的地址，用来在swarm中认出自己
+func selfAdr() string {
+	trueIpAdr.mu.Lock()
+	defer trueIpAdr.mu.Unlock()
+	return trueIpAdr.ip + ":" + strconv.Itoa(cfg.ClientPort)
+}
+
+// 与服务器的websocket连接。websocket不支持并发写，心跳回复和下载完成通知共用一个连接
+var server struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
 
 //与服务器对接
 
-// 与服务器建立websocket连接，并且进行持续性的心跳检测
-func connect() {
-	wsURL := "ws://" + cfg.ServiceAdr + "/"
-	header := http.Header{}
-	header.Set("Authorization", cfg.token)
-	header.Set("X-User-Port", strconv.Itoa(cfg.ClientPort))
+const (
+	reconnectMin = time.Second //断线后第一次重连前的等待时间，之后每次失败翻倍
+	reconnectMax = time.Minute //重连间隔的上限
+)
 
-	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+// 与服务器建立websocket连接，并且进行持续性的心跳检测。断线后自动重连，直到客户端退出
+func connect() {
+	var err error
+	peerID, err = loadPeerID()
 	if err != nil {
-		log.Println("与服务器建立连接失败:", err)
+		log.Println("读取客户端标识失败:", err)
 		return
 	}
 	//启动限速器
 	limit()
 	//开启配置文件监视器
 	go hotReset()
-	//心跳和断线检测
-	go heartBeat(conn)
-	sendFileList() //发送文件列表
-	//TODO:断线重连
+	conn, err := dial()
+	if err != nil {
+		log.Println("与服务器建立连接失败:", err)
+	}
+	go keepConnected(conn)
+}
+
+// 建立连接，发送hello。服务器的数据接口只认已经建立连接的客户端，断线期间的请求都会被拒绝
+func dial() (*websocket.Conn, error) {
+	wsURL := "ws://" + cfg.ServiceAdr + "/"
+	header := http.Header{}
+	header.Set("Authorization", accessToken()) //每次都用最新的token，断线期间token可能已经续期
+	header.Set("X-User-Port", strconv.Itoa(cfg.ClientPort))
+	header.Set("X-Peer-ID", peerID)
+
+	conn, _, err := websocket.DefaultDialer.Dial(wsURL, header)
+	if err != nil {
+		return nil, err
+	}
+	server.mu.Lock()
+	server.conn = conn
+	server.mu.Unlock()
+	sendHello()   //发送协议版本和已下载的文件列表
+	resendHaves() //服务器可能重启过，正在下载的文件已有的分片也要重新告诉它
+	return conn, nil
+}
+
+// 处理连接上的消息，断线后按指数退避重连，直到客户端退出
+func keepConnected(conn *websocket.Conn) {
+	delay := reconnectMin
+	for {
+		if conn != nil {
+			heartBeat(conn) //心跳和断线检测，断线后返回
+			server.mu.Lock()
+			if server.conn == conn {
+				server.conn = nil
+			}
+			server.mu.Unlock()
+			delay = reconnectMin
+		}
+		select {
+		case <-stopping:
+			return
+		case <-time.After(delay):
+		}
+		var err error
+		if conn, err = dial(); err != nil {
+			log.Println("重新连接服务器失败:", err)
+			if delay *= 2; delay > reconnectMax {
+				delay = reconnectMax
+			}
+			continue
+		}
+		log.Println("已重新连接服务器")
+	}
+}
+
+// 向服务器发送一条控制消息
+func sendMessage(t protocol.Type, data any) error {
+	buf, err := protocol.New(t, data)
+	if err != nil {
+		return err
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.conn == nil {
+		return errors.New("未与服务器建立连接")
+	}
+	return server.conn.WriteMessage(websocket.TextMessage, buf)
+}
+
+// 发送hello，告诉服务器协议版本和已下载的文件，同时初始化hasDownQueue
+func sendHello() {
+	files, err := os.ReadDir("./down")
+	if err != nil {
+		log.Fatalf("读取已下载文件列表失败：%v", err)
+	}
+	hello := protocol.Hello{Version: protocol.Version, Files: make([]string, 0, len(files))}
+	isDowningMu.Lock()
+	hasDownedQueue = make(map[string]*hasDowned)
+	for _, file := range files {
+		hello.Files = append(hello.Files, file.Name())
+		hasDownedQueue[file.Name()] = new(hasDowned)
+	}
+	isDowningMu.Unlock()
+
+	if err = sendMessage(protocol.TypeHello, hello); err != nil {
+		log.Println("向服务器发送文件列表失败:", err)
+	}
+}
+
+// 把正在下载的文件已经下好的分片重新告诉服务器
+func resendHaves() {
+	enginesMu.Lock()
+	list := make([]*downEngine, 0, len(engines))
+	for _, engine := range engines {
+		list = append(list, engine)
+	}
+	enginesMu.Unlock()
+	for _, engine := range list {
+		engine.mu.Lock()
+		indexes := make([]int, 0, len(engine.fileQueue))
+		for _, f := range engine.fileQueue {
+			indexes = append(indexes, f.index)
+		}
+		engine.mu.Unlock()
+		if len(indexes) == 0 {
+			continue
+		}
+		if err := sendMessage(protocol.TypeHave, protocol.Have{FileName: engine.fileName, Pieces: indexes}); err != nil {
+			log.Println("通知服务器", engine.fileName, "的分片失败:", err)
+		}
+	}
 }
 
-// 心跳和断线检测
+// 通知服务器本地有了某个文件，发送失败只记录日志
+func announce(t protocol.Type, fileName string) {
+	if err := sendMessage(t, protocol.File{FileName: fileName}); err != nil {
+		log.Println("通知服务器", fileName, "失败:", err)
+	}
+}
+
+// 心跳和断线检测，同时处理服务器发来的控制消息
 func heartBeat(conn *websocket.Conn) {
 	defer conn.Close()
 	for {
-		typ, _, err := conn.ReadMessage()
+		typ, buf, err := conn.ReadMessage()
 		if err != nil {
 			log.Println("与服务器断开连接:", err)
 			return
 		}
-		if typ == websocket.TextMessage {
-			err = conn.WriteMessage(websocket.TextMessage, []byte("pong!"))
-			if err != nil {
+		if typ != websocket.TextMessage {
+			continue
+		}
+		msg, err := protocol.Parse(buf)
+		if err != nil {
+			log.Println("服务器消息格式错误:", err)
+			continue
+		}
+		switch msg.Type {
+		case protocol.TypePing:
+			if err = sendMessage(protocol.TypePong, nil); err != nil {
 				log.Println("发送心跳包失败:", err)
 				return
 			}
+		case protocol.TypeWelcome:
+			var w protocol.Welcome
+			if err = msg.Decode(&w); err != nil {
+				log.Println(err)
+				continue
+			}
+			trueIpAdr.mu.Lock()
+			trueIpAdr.ip = w.IP
+			trueIpAdr.mu.Unlock()
+			setTrackerKey(w.TicketKey)
+		case protocol.TypeChanged, protocol.TypeRemove:
+			var f protocol.File
+			if err = msg.Decode(&f); err != nil {
+				log.Println(err)
+				continue
+			}
+			forgetFile(f.FileName)
+			if msg.Type == protocol.TypeChanged {
+				log.Println(f.FileName, "已在服务器更新，本地文件不再提供上传，请重新下载")
+			} else {
+				log.Println(f.FileName, "已从服务器删除，本地文件不再提供上传")
+			}
+		case protocol.TypeNotice:
+			var n protocol.Notice
+			if msg.Decode(&n) == nil {
+				log.Println("服务器提示:", n.Message)
+			}
+		case protocol.TypePeers:
+			var delta protocol.Peers
+			if err = msg.Decode(&delta); err != nil {
+				log.Println(err)
+				continue
+			}
+			updatePeers(delta)
+		case protocol.TypeError:
+			var e protocol.Error
+			if msg.Decode(&e) == nil {
+				log.Println("服务器报告错误:", e.Type, e.Message)
+			}
+		default:
+			err = sendMessage(protocol.TypeError, protocol.Error{Type: msg.Type, Message: "不支持的消息类型"})
+			if err != nil {
+				log.Println("回复服务器失败:", err)
+			}
 		}
 	}
 }
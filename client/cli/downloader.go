@@ -1,17 +1,19 @@
 package cli
 
 import (
+	"Gdown/god"
+	"Gdown/protocol"
 	"bytes"
 	"context"
-	"encoding/gob"
+	"encoding/hex"
 	"encoding/json"
-	"hash/crc32"
 	"io"
 	"log"
 	"net/http"
 	"os"
 	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -21,11 +23,11 @@ import (
 //2.根据元数据的分块，对服务器和客户端进行轮询操作。轮流请求文件的分片。
 //3.假如对应客户端没有该文件的分片（对应客户端可能也在进行下载），则询问下一个客户端or服务器有无该文件分片。
 //4.假如询问的客户端超过三次没有回应，则把它踢出维护的客户端ip池。
-//5.每隔一段时间向文件服务器询问最新的客户端列表。
+//5.服务器通过websocket推送客户端的加入、分片更新和离开，下载过程中随时更新客户端列表。
 //6.对应3：如果一个客户端跑满了（达到了上传速率限制），则也询问下一个客户端or服务器。
 
 var (
-	DownChan = make(chan string, 10) //下载任务队列（限制同时下载的文件数）
+	DownChan = make(chan string, 10) //下载任务队列（限制同时下载的文件数）。可以用“文件名@默克尔根”指定期望的文件身份
 )
 
 const (
@@ -33,36 +35,56 @@ const (
 	clientErr       = 1
 	serverNormalErr = 400
 	fallErr         = 2
+	busyErr         = 503 //对方忙，按Retry-After等一会儿再请求
 )
 
+const maxRetryAfter = time.Minute //对方要求等待的时间上限，不让一个客户端把分片拖住太久
+
+// 解析429或503响应的Retry-After，可以是秒数或者HTTP日期。没有或者格式错误时等一秒
+func retryAfter(resp *http.Response) time.Duration {
+	wait := time.Second
+	v := resp.Header.Get("Retry-After")
+	if secs, err := strconv.Atoi(v); err == nil && secs >= 0 {
+		wait = time.Duration(secs) * time.Second
+	} else if at, err := http.ParseTime(v); err == nil {
+		wait = time.Until(at)
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryAfter {
+		wait = maxRetryAfter
+	}
+	return wait
+}
+
+const (
+	pieceTimeoutBase = 10 * time.Second //建立连接、等待响应的时间
+	minPieceRate     = 64 << 10         //分片传输速度的下限（字节每秒），比这还慢视为对方卡住了
+)
+
+// 下载一个分片的超时时间。分片最大可以到1GB，限速时传输也会变慢，超时时间按分片大小计算
+func pieceTimeout(size int) time.Duration {
+	return pieceTimeoutBase + time.Duration(size)*time.Second/minPieceRate
+}
+
 // 下载引擎
 type downEngine struct {
 	fileName        string    //下载的文件名
+	root            string    //用户指定的默克尔根，为空时不核对
 	ipAdr           []*client //拥有该文件的客户端ip列表
-	fileInfo        fileInfo
+	fileInfo        god.Meta
 	fileQueue       []tempFileInfo   //文件队列，用于记录下载成功的分片，按照顺序进行排列
 	downQueue       []int            //下载队列，排队下载
 	successNum      int              //下载成功的分片数
 	finish          chan string      //下载完成信号
 	wg              sync.WaitGroup   //等待所有分片下载完成
-	mu              sync.Mutex       //防止并发写successNum的时候冲突
+	mu              sync.Mutex       //保护fileQueue、downQueue和successNum，调度协程和下载协程都会读写
 	downMessageChan chan downMessage //下载消息队列
 	clientMu        sync.Mutex       //客户端列表的互斥锁，用于删除客户端时防止冲突
-}
-
-// 文件元数据
-type fileInfo struct {
-	FileName      string
-	FilePiecesNum int
-	FileSize      int
-	FilePieces    []*piece
-}
-
-type piece struct {
-	PieceIndex int    //第几片
-	PieceStart int    //记录分片处在文件的起始位置
-	PieceSize  int    //分片的大小
-	PieceHash  uint32 //分片的哈希值，用于校验
+	quit            chan struct{}    //暂停下载时关闭，停止多线程下载控制器
+	inflight        sync.WaitGroup   //正在下载的分片，发送给多线程下载控制器之前加1，下载协程结束时减1
+	ticket          downTicket       //向其它客户端请求分片用的凭证
 }
 
 // 临时文件信息
@@ -73,28 +95,47 @@ type tempFileInfo struct {
 
 // 管道传递的消息
 type downMessage struct {
-	index       int //分片索引
-	client      *client
-	clientIndex int //客户端在ipAdr中的索引，用于删除客户端
+	index  int //分片索引
+	client *client
 }
 
 // DownControl 下载总控器
 func DownControl() {
-	//初始化下载队列
-	isDowningQueue = make(map[string]*isDowning)
-
 	//启动下载进程
 	for {
 		select {
-		case fileName := <-DownChan:
-			go fileHandler(fileName)
+		case task := <-DownChan:
+			fileName, root := splitPinnedRoot(task)
+			if isStopping() {
+				log.Println("正在退出，不再开始新的下载：", fileName)
+				continue
+			}
+			tasks.Add(1)
+			go fileHandler(fileName, root)
 		}
 	}
 }
 
-// 单个文件的下载控制调度器
-func fileHandler(fileName string) {
-	engine := newDownTask(fileName)           //新建下载任务
+// 拆分“文件名@默克尔根”。@后面不是64位十六进制时，整个当作文件名
+func splitPinnedRoot(task string) (fileName, root string) {
+	i := strings.LastIndexByte(task, '@')
+	if i < 0 || len(task)-i-1 != 64 {
+		return task, ""
+	}
+	if _, err := hex.DecodeString(task[i+1:]); err != nil {
+		return task, ""
+	}
+	return task[:i], strings.ToLower(task[i+1:])
+}
+
+// 单个文件的下载控制调度器。root不为空时，元数据的默克尔根必须与它一致
+func fileHandler(fileName, root string) {
+	defer tasks.Done()
+	engine := newDownTask(fileName, root) //新建下载任务
+	if engine == nil {
+		log.Println(fileName, "获取元数据失败，取消下载")
+		return
+	}
 	pieceNum := engine.fileInfo.FilePiecesNum //获取文件的分片数
 
 	//将服务器也作为一个下载节点
@@ -105,39 +146,55 @@ func fileHandler(fileName string) {
 	}
 	engine.ipAdr = append(engine.ipAdr, &serverAdr) //将服务器也作为一个下载节点
 
-	isDowningQueue[fileName] = &isDowning{filePiece: make(map[int]string)} //将文件加入到正在下载的队列中
+	startDowning(fileName, &engine.fileInfo) //将文件加入到正在下载的队列中
+	registerEngine(engine)                   //开始接收服务器推送的客户端变化
+	defer unregisterEngine(engine)
+
+	done := engine.loadState() //上次退出时已经下载好的分片
 
 	engine.downQueue = make([]int, 0, pieceNum)
 	//初始化下载队列
 	for i := 0; i < pieceNum; i++ {
-		engine.downQueue = append(engine.downQueue, i)
+		if !done[i] {
+			engine.downQueue = append(engine.downQueue, i)
+		}
 	}
 
 	go engine.multithreadingControl()
 
 	var j = 0 //p2p服务端轮询控制
-	for engine.successNum < pieceNum {
-		for _, i := range engine.downQueue {
+	for engine.doneCount() < pieceNum {
+		if isStopping() {
+			engine.pause()
+			return
+		}
+		self := selfAdr()
+		for !isStopping() {
+			i, ok := engine.nextPiece()
+			if !ok {
+				break
+			}
 			var client *client
-			//获取除了自己以外的client
+			//获取除了自己以外、拥有这个分片的client。服务器拥有所有分片，总能找到
 			for j++; ; j++ {
+				engine.clientMu.Lock()
 				if j >= len(engine.ipAdr) {
 					j = 0
 				}
-				engine.clientMu.Lock()
-				if engine.ipAdr[j].IPAdr != trueIpAdr+":"+strconv.Itoa(cfg.ClientPort) {
+				if engine.ipAdr[j].IPAdr != self && engine.ipAdr[j].has(i) {
 					client = engine.ipAdr[j]
 					engine.clientMu.Unlock()
 					break
 				}
 				engine.clientMu.Unlock()
 			}
-			engine.downMessageChan <- downMessage{i, client, j}
-			engine.downQueue = engine.downQueue[1:] //移除遍历到的元素
+			engine.inflight.Add(1) //在交给下载控制器之前计数，pause不会漏掉已经交出去的分片
+			engine.downMessageChan <- downMessage{i, client}
 		}
 		time.Sleep(time.Second * 1)
 	}
 
+	engine.inflight.Wait() //最后一个分片的下载协程可能还没结束
 	engine.wg.Add(1)
 	//下载完成，发送下载完成信号
 	engine.finish <- fileName
@@ -148,28 +205,49 @@ func fileHandler(fileName string) {
 func (engine *downEngine) multithreadingControl() {
 	for {
 		select {
+		case <-engine.quit:
+			return
 		case msg := <-engine.downMessageChan:
 			go func() {
-				downLimitGet()   //下载限速，获取令牌
-				defer downDown() //放回令牌
-				data, isSuccess, code := engine.downPiece(msg.index, msg.client.IPAdr)
+				defer engine.inflight.Done()
+				size := engine.fileInfo.FilePieces[msg.index].PieceSize //分片大小以元数据为准
+				downLimitGet(size)                                      //下载限速，获取额度
+				held := true
+				defer func() {
+					if held {
+						downDown(size) //放回额度
+					}
+				}()
+				data, isSuccess, code, wait := engine.downPiece(msg.index, msg.client)
 				if !isSuccess {
-					engine.downQueue = append(engine.downQueue, msg.index) //下载失败，重新加入到下载队列中
+					if !msg.client.isServer {
+						peerFailures.Inc()
+					}
+					if code == busyErr { //服务器限流，等它要求的时间之后再排队，不然只会接着收到503
+						downDown(size) //等待期间不占下载额度
+						held = false
+						select {
+						case <-time.After(wait):
+						case <-engine.quit:
+						}
+					}
+					engine.retry(msg.index) //下载失败，重新加入到下载队列中
 					if code == fallErr {
 						msg.client.fallTimes++
-						if msg.client.fallTimes >= 3 && !msg.client.isServer { //大于等于3时且不是服务器且未被其它goroutine获取时，移除该客户端
-							msg.client.isGet.Lock()
-							engine.removeFallClient(msg.clientIndex)
+						if msg.client.fallTimes >= 3 && !msg.client.isServer && msg.client.isGet.TryLock() { //大于等于3时且不是服务器且未被其它goroutine获取时，移除该客户端
+							engine.removeFallClient(msg.client)
 						}
 					}
 					return
 				}
 				if !writeTempFile(data, msg.index, engine.fileName) {
-					engine.downQueue = append(engine.downQueue, msg.index) //下载失败，重新加入到下载队列中
+					engine.retry(msg.index) //下载失败，重新加入到下载队列中
 					return
 				}
 
-				engine.mu.Lock() //防止并发写successNum的时候冲突
+				engine.havePiece(msg.index)
+
+				engine.mu.Lock()
 				//将分片加入到文件队列中
 				engine.fileQueue = append(engine.fileQueue, tempFileInfo{msg.index, "./temp/" + engine.fileName + strconv.Itoa(msg.index) + ".tmp"})
 
@@ -180,30 +258,67 @@ func (engine *downEngine) multithreadingControl() {
 				engine.mu.Unlock()
 			}()
 		case fileName := <-engine.finish:
-			writeFile(engine.fileQueue, fileName)
-			//将文件从正在下载队列中移除
-			isDowningQueue[fileName].mu.TryLock()
-			delete(isDowningQueue, fileName)
-			hasDownedQueue[fileName] = struct{}{} //将文件加入到已下载队列中
+			writeFile(engine.fileQueue, &engine.fileInfo)
+			finishDowning(fileName)                   //将文件从正在下载队列移到已下载队列
+			announce(protocol.TypeComplete, fileName) //通知服务器，可以把这个文件分享给其它客户端了
+			engine.removeState()
 			engine.wg.Done()
 			return
 		}
 	}
 }
 
-// 新建下载任务
-func newDownTask(fileName string) *downEngine {
+// 取出下载队列中的下一个分片
+func (engine *downEngine) nextPiece() (int, bool) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	if len(engine.downQueue) == 0 {
+		return 0, false
+	}
+	i := engine.downQueue[0]
+	engine.downQueue = engine.downQueue[1:]
+	return i, true
+}
+
+// 下载失败的分片重新排队
+func (engine *downEngine) retry(index int) {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	engine.downQueue = append(engine.downQueue, index)
+}
+
+// 已经下载好的分片数
+func (engine *downEngine) doneCount() int {
+	engine.mu.Lock()
+	defer engine.mu.Unlock()
+	return engine.successNum
+}
+
+// 暂停下载：等正在下载的分片完成，保存进度。临时文件保留，下次下载时接着用
+func (engine *downEngine) pause() {
+	engine.inflight.Wait()
+	close(engine.quit)
+	stopDowning(engine.fileName)
+	engine.saveState()
+}
+
+// 新建下载任务。获取元数据失败时返回nil
+func newDownTask(fileName, root string) *downEngine {
 	var d downEngine
 	d.fileName = fileName
+	d.root = root
 	d.successNum = 0
 	d.finish = make(chan string)
 	d.downMessageChan = make(chan downMessage)
-	d.getMetaData()
+	d.quit = make(chan struct{})
+	if !d.getMetaData() {
+		return nil
+	}
 	return &d
 }
 
 // 从服务器获取元数据，实际上就是获取种子文件
-func (engine *downEngine) getMetaData() {
+func (engine *downEngine) getMetaData() bool {
 	u := "http://" + cfg.ServiceAdr + "/meta"
 
 	var data struct {
@@ -213,18 +328,20 @@ func (engine *downEngine) getMetaData() {
 	encodeData, err := json.Marshal(data)
 	if err != nil {
 		log.Println("序列化文件名失败:", err)
-		return
+		return false
 	}
 
 	req, err := http.NewRequest("GET", u, bytes.NewBuffer(encodeData))
 	if err != nil {
 		log.Println("创建请求失败:", err)
-		return
+		return false
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 	req.Header.Set("Content-Length", strconv.Itoa(len(encodeData)))
 	req.Header.Set("User-Agent", "GDown")
 	req.Header.Set("X-User-Port", strconv.Itoa(cfg.ClientPort))
+	req.Header.Set("X-Peer-ID", peerID)
+	authorize(req)
 
 	c := http.Client{
 		Timeout: time.Second * 30, //设置超时时间
@@ -232,63 +349,76 @@ func (engine *downEngine) getMetaData() {
 	resp, err := c.Do(req)
 	if err != nil {
 		log.Println("发送请求失败:", err)
-		return
+		return false
 	}
 	defer resp.Body.Close()
 	body, err := io.ReadAll(resp.Body)
 	if err != nil {
 		log.Println("读取服务器回传信息失败:", err)
-		return
+		return false
 	}
 	if resp.StatusCode != http.StatusOK {
 		log.Println(resp.StatusCode, ":", string(body))
-		return
+		return false
 	}
 	//反序列化元数据
 	var meta struct {
-		Message []byte   `json:"message"`
-		IpAdr   []string `json:"ip_adr"`
+		Message []byte `json:"message"`
+		Peers   []struct {
+			Addr     string            `json:"addr"`
+			Bitfield protocol.Bitfield `json:"bitfield"`
+		} `json:"peers"`
+		Ticket        string `json:"ticket"`
+		TicketExpires int64  `json:"ticket_expires"`
 	}
 	err = json.Unmarshal(body, &meta)
 	if err != nil {
 		log.Println("解析服务器回传信息失败:", err)
-		return
+		return false
 	}
+	engine.ticket.set(meta.Ticket, meta.TicketExpires)
 	//将元数据写入到文件中
 	err = os.WriteFile("./fileInfo/"+engine.fileName+".god", meta.Message, 0666)
 
-	//获取拥有此文件的客户端ip列表
-	for _, ip := range meta.IpAdr {
+	//获取拥有此文件分片的客户端列表
+	for _, p := range meta.Peers {
 		client := client{
-			IPAdr:     ip,
+			IPAdr:     p.Addr,
 			fallTimes: 0,
 			isServer:  false,
+			pieces:    p.Bitfield,
 		}
 		engine.ipAdr = append(engine.ipAdr, &client)
 	}
-	engine.unmarshalGod()
+	if !engine.unmarshalGod() {
+		return false
+	}
+	//核对文件身份。期望的默克尔根必须来自服务器以外的可信渠道（比如分享者直接告诉用户），
+	//和元数据一起从服务器拿到的根证明不了什么
+	if engine.root != "" && engine.fileInfo.ID() != engine.root {
+		log.Println(engine.fileName, "元数据的默克尔根与指定的不一致，可能被篡改")
+		return false
+	}
+	if engine.fileInfo.HashAlgo == god.HashCRC32 {
+		log.Println(engine.fileName, "元数据使用crc32校验，无法防止其它客户端伪造分片")
+	}
+	return true
 }
 
-// 解析元数据
-func (engine *downEngine) unmarshalGod() {
-	file, err := os.Open("./fileInfo/" + engine.fileName + ".god")
+// 解析元数据。版本不支持或格式错误时god包会返回明确的错误。
+func (engine *downEngine) unmarshalGod() bool {
+	meta, err := god.ReadFile("./fileInfo/" + engine.fileName + ".god")
 	if err != nil {
-		log.Println("打开元数据文件失败:", err)
-		return
-	}
-	defer file.Close()
-	var meta fileInfo
-	dec := gob.NewDecoder(file)
-	if err := dec.Decode(&meta); err != nil {
 		log.Println("解析元数据失败:", err)
-		return
+		return false
 	}
-	engine.fileInfo = meta
+	engine.fileInfo = *meta
+	return true
 }
 
 // 下载分片数据
-func (engine *downEngine) downPiece(index int, client string) ([]byte, bool, int) {
-	u := "http://" + client + "/down"
+func (engine *downEngine) downPiece(index int, peer *client) ([]byte, bool, int, time.Duration) {
+	u := "http://" + peer.IPAdr + "/down"
 	var data struct {
 		FileName string `json:"file_name"`
 	}
@@ -296,19 +426,19 @@ func (engine *downEngine) downPiece(index int, client string) ([]byte, bool, int
 	encodeData, err := json.Marshal(data)
 	if err != nil {
 		log.Println("序列化文件名失败:", err)
-		return nil, false, clientErr
+		return nil, false, clientErr, 0
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	ctx, cancel := context.WithTimeout(context.Background(), pieceTimeout(engine.fileInfo.FilePieces[index].PieceSize))
 	defer cancel()
 	req, err := http.NewRequestWithContext(ctx, "GET", u, bytes.NewBuffer(encodeData))
 	if err != nil {
 		log.Println("创建请求失败:", err)
-		return nil, false, clientErr
+		return nil, false, clientErr, 0
 	}
 
 	start := engine.fileInfo.FilePieces[index].PieceStart
-	end := start + engine.fileInfo.FilePieces[index].PieceSize
+	end := start + engine.fileInfo.FilePieces[index].PieceSize - 1 //range的结尾是包含在内的
 	startStr := strconv.Itoa(start)
 	endStr := strconv.Itoa(end)
 
@@ -316,69 +446,104 @@ func (engine *downEngine) downPiece(index int, client string) ([]byte, bool, int
 	req.Header.Set("Content-Length", strconv.Itoa(len(encodeData)))
 	req.Header.Set("User-Agent", "GDown")
 	req.Header.Set("Range", "bytes="+startStr+"-"+endStr)
+	req.Header.Set("X-Peer-ID", peerID)
+	if peer.isServer {
+		authorize(req)
+	} else {
+		req.Header.Set(protocol.TicketHeader, engine.currentTicket()) //其它客户端只认追踪器签发的凭证
+	}
 	req.Header.Set("Size", strconv.Itoa(engine.fileInfo.FilePieces[index].PieceSize))
 
 	c := http.Client{}
 	resp, err := c.Do(req)
 	if err != nil {
 		log.Println("发送请求失败:", err)
-		return nil, false, fallErr
+		return nil, false, fallErr, 0
 	}
 	defer resp.Body.Close()
 
-	body, err := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusPartialContent { //服务器返回206，客户端之间返回200
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024)) //错误信息只是为了记日志
+		log.Println(resp.StatusCode, ":", string(msg))
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			return nil, false, busyErr, retryAfter(resp)
+		}
+		return nil, false, serverNormalErr, 0
+	}
+	//对方不可信，最多只读分片大小多一个字节，长度不对直接丢弃，不必算哈希
+	size := engine.fileInfo.FilePieces[index].PieceSize
+	body, err := io.ReadAll(io.LimitReader(resp.Body, int64(size)+1))
 	if err != nil {
 		log.Println("读取服务器回传信息失败:", err)
-		return nil, false, clientErr
+		return nil, false, clientErr, 0
 	}
-	if resp.StatusCode != http.StatusOK {
-		log.Println(resp.StatusCode, ":", string(body))
-		return nil, false, serverNormalErr
+	if len(body) != size {
+		log.Println("第"+strconv.Itoa(index)+"片长度为", len(body), "，应为", size)
+		return nil, false, fallErr, 0
 	}
-	if hash(body) != engine.fileInfo.FilePieces[index].PieceHash {
+	if engine.fileInfo.HashAlgo.Sum(body) != engine.fileInfo.FilePieces[index].PieceHash {
 		log.Println("第" + strconv.Itoa(index) + "片校验失败")
-		return nil, false, fallErr
+		hashFailures.Inc()
+		return nil, false, fallErr, 0
 	}
+	bytesDownloaded.Add(float64(len(body)))
+	return body, true, success, 0
+}
 
-	isDowningMu.Lock()
-	isDowningQueue[engine.fileName].filePiece[start] = client //将分片加入到正在下载的队列中
-	isDowningMu.Unlock()
-	return body, true, success
+// 分片已经写入临时文件，可以提供给其它客户端了。记录下来，并用一条have通知服务器
+func (engine *downEngine) havePiece(indexes ...int) {
+	fileData, ok := downingFile(engine.fileName)
+	if !ok {
+		return
+	}
+	fileData.mu.Lock()
+	for _, index := range indexes {
+		fileData.filePiece[engine.fileInfo.FilePieces[index].PieceStart] = engine.fileName + strconv.Itoa(index) //临时文件名
+	}
+	fileData.mu.Unlock()
+
+	err := sendMessage(protocol.TypeHave, protocol.Have{FileName: engine.fileName, Pieces: indexes})
+	if err != nil {
+		log.Println("通知服务器", engine.fileName, "的分片失败:", err)
+	}
 }
 
-// 写入文件
-func writeFile(filesData []tempFileInfo, fileName string) {
+// 写入文件。目录分享会在下载目录下重建整个目录树
+func writeFile(filesData []tempFileInfo, meta *god.Meta) {
 	//将队列按照顺序进行排序，保证一致性
 	sort.Slice(filesData, func(i, j int) bool {
 		return filesData[i].index < filesData[j].index
 	})
 
-	//合并临时文件
-	file, err := os.OpenFile("./down/"+fileName, os.O_CREATE|os.O_WRONLY, 0644)
+	if !god.ValidName(meta.FileName) {
+		log.Println("文件名不合法，拒绝写入:", meta.FileName)
+		return
+	}
+	//合并临时文件，按分片在整个分享中的位置写入，分片跨越文件边界时会拆开写到各个文件里
+	share, err := god.Create("./down/"+meta.FileName, meta)
 	if err != nil {
 		log.Println("创建文件失败:", err)
 		return
 	}
-	defer file.Close()
+	defer share.Close()
 	for _, fileData := range filesData {
 		data, err := os.ReadFile(fileData.name)
 		if err != nil {
 			log.Println("读取临时文件失败:", err)
 			return
 		}
-		_, err = file.Write(data)
+		_, err = share.WriteAt(data, int64(meta.FilePieces[fileData.index].PieceStart))
 		if err != nil {
 			log.Println("写入文件失败:", err)
 			return
 		}
-		filesData = filesData[1:] //移除遍历到的元素
 		err = os.Remove(fileData.name)
 		if err != nil {
 			log.Println("删除临时文件失败:", err)
 			continue
 		}
 	}
-	log.Println(fileName + "下载完成")
+	log.Println(meta.FileName + "下载完成")
 }
 
 // 写临时文件
@@ -395,8 +560,3 @@ func writeTempFile(data []byte, index int, fileName string) bool {
 	}
 	return true
 }
-
-// 哈希值校验
-func hash(data []byte) uint32 {
-	return crc32.ChecksumIEEE(data)
-}
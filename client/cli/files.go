@@ -0,0 +1,96 @@
+package cli
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+//查询服务器上的文件列表
+
+const listPageSize = 20
+
+// ListFiles 列出服务器上的文件。keyword为文件名关键字，为空时列出全部。返回总页数
+func ListFiles(keyword string, page int) int {
+	if accessToken() == "" {
+		fmt.Println("请先登录")
+		return 0
+	}
+	query := url.Values{}
+	query.Set("page", strconv.Itoa(page))
+	query.Set("page_size", strconv.Itoa(listPageSize))
+	if keyword != "" {
+		query.Set("name", keyword)
+	}
+	req, err := http.NewRequest("GET", "http://"+cfg.ServiceAdr+"/files?"+query.Encode(), nil)
+	if err != nil {
+		log.Println("创建请求失败:", err)
+		return 0
+	}
+	req.Header.Set("User-Agent", "GDown")
+	req.Header.Set("X-Peer-ID", peerID)
+	authorize(req)
+
+	c := http.Client{
+		Timeout: time.Second * 30, //设置超时时间
+	}
+	resp, err := c.Do(req)
+	if err != nil {
+		log.Println("发送请求失败:", err)
+		return 0
+	}
+	defer resp.Body.Close()
+
+	//解析服务器回传信息
+	var response struct {
+		Message string `json:"message"`
+		Total   int    `json:"total"`
+		Files   []struct {
+			FileName string `json:"file_name"`
+			FileSize int    `json:"file_size"`
+			PieceNum int    `json:"piece_num"`
+			IsDir    bool   `json:"is_dir"`
+			Seeders  int    `json:"seeders"`
+			ModTime  string `json:"mod_time"`
+		} `json:"files"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&response)
+	if err != nil {
+		log.Println("解析服务器回传信息失败:", err)
+		return 0
+	}
+	if resp.StatusCode != http.StatusOK {
+		log.Println("获取文件列表失败:", response.Message)
+		return 0
+	}
+
+	pages := (response.Total + listPageSize - 1) / listPageSize
+	fmt.Printf("共%d个文件，第%d/%d页\n", response.Total, page, pages)
+	fmt.Printf("%-40s %10s %8s %6s  %s\n", "文件名", "大小", "分片数", "做种数", "修改时间")
+	for _, f := range response.Files {
+		name := f.FileName
+		if f.IsDir {
+			name += "/"
+		}
+		fmt.Printf("%-40s %10s %8d %6d  %s\n", name, formatSize(f.FileSize), f.PieceNum, f.Seeders, f.ModTime)
+	}
+	return pages
+}
+
+// 将字节数转换为便于阅读的形式
+func formatSize(size int) string {
+	const unit = 1024
+	if size < unit {
+		return strconv.Itoa(size) + "B"
+	}
+	value, exp := float64(size)/unit, 0
+	for value >= unit && exp < 3 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%cB", value, "KMGT"[exp])
+}
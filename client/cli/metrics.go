@@ -0,0 +1,56 @@
+package cli
+
+//Prometheus监控指标，在metrics_addr上通过/metrics导出，和服务端一样不经过对其它客户端开放的上传端口。
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	bytesDownloaded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gdown_client_downloaded_bytes_total",
+		Help: "校验通过的下载字节数",
+	})
+	bytesUploaded = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gdown_client_uploaded_bytes_total",
+		Help: "上传给其它客户端的字节数",
+	})
+	hashFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gdown_client_piece_hash_failures_total",
+		Help: "分片校验失败的次数",
+	})
+	peerFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gdown_client_peer_failures_total",
+		Help: "向其它客户端请求分片失败的次数",
+	})
+)
+
+// 在addr上提供/metrics，监听失败只记录日志，不影响上传下载
+func serveMetrics(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Println("启动监控指标服务失败:", err)
+		}
+	}()
+	return srv
+}
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gdown_client_active_tasks",
+		Help: "正在进行的下载任务数",
+	}, func() float64 {
+		enginesMu.Lock()
+		defer enginesMu.Unlock()
+		return float64(len(engines))
+	}))
+}
@@ -1,10 +1,10 @@
 package cli
 
 import (
-	"bytes"
-	"encoding/json"
+	"Gdown/god"
+	"Gdown/protocol"
+	"errors"
 	"github.com/gin-gonic/gin"
-	"io"
 	"log"
 	"net/http"
 	"os"
@@ -19,41 +19,119 @@ import (
 type isDowning struct {
 	mu        sync.Mutex
 	filePiece map[int]string //key为起始位置，value为临时分片的name
+	meta      *god.Meta      //文件的元数据，核对请求的分片大小
 }
 
 // 客户端结构，记录客户端信息，做出更多的判断
 type client struct {
-	IPAdr     string     //客户端ip地址
-	fallTimes int        //客户端连续失败次数
-	isServer  bool       //是否是服务器
-	isGet     sync.Mutex //是否被删除器获取
+	IPAdr     string            //客户端ip地址
+	fallTimes int               //客户端连续失败次数
+	isServer  bool              //是否是服务器
+	isGet     sync.Mutex        //是否被删除器获取
+	pieces    protocol.Bitfield //拥有的分片，来自服务器的记录
 }
 
+// 客户端是否拥有第i个分片。服务器拥有全部分片
+func (c *client) has(i int) bool {
+	return c.isServer || c.pieces.Has(i)
+}
+
+// 已经下载完成的文件。元数据和分享在第一次被请求分片时加载，之后一直复用，不用每个请求都解析一遍元数据
+type hasDowned struct {
+	once  sync.Once
+	meta  *god.Meta
+	share *god.Share
+	err   error
+}
+
+// 加载元数据，打开分享
+func (f *hasDowned) load(fileName string) (*god.Meta, *god.Share, error) {
+	f.once.Do(func() {
+		f.meta, f.err = god.ReadFile("./fileInfo/" + fileName + ".god")
+		if f.err == nil {
+			f.share, f.err = god.Open("./down/"+fileName, f.meta)
+		}
+	})
+	return f.meta, f.share, f.err
+}
+
+// 两个队列的读写都要持有isDowningMu，通过下面的函数访问
 var (
-	isDowningQueue map[string]*isDowning //正在下载的文件队列
-	hasDownedQueue map[string]struct{}   //已经下载的文件队列
-	isDowningMu    sync.Mutex            //并发安全
+	isDowningQueue = make(map[string]*isDowning) //正在下载的文件队列
+	hasDownedQueue = make(map[string]*hasDowned) //已经下载的文件队列
+	isDowningMu    sync.Mutex                    //并发安全
 )
 
+// 将文件加入到正在下载的队列中
+func startDowning(fileName string, meta *god.Meta) {
+	isDowningMu.Lock()
+	defer isDowningMu.Unlock()
+	isDowningQueue[fileName] = &isDowning{filePiece: make(map[int]string), meta: meta}
+}
+
+// 正在下载的文件
+func downingFile(fileName string) (*isDowning, bool) {
+	isDowningMu.Lock()
+	defer isDowningMu.Unlock()
+	fileData, ok := isDowningQueue[fileName]
+	return fileData, ok
+}
+
+// 暂停下载，将文件从正在下载的队列中移除
+func stopDowning(fileName string) {
+	isDowningMu.Lock()
+	defer isDowningMu.Unlock()
+	delete(isDowningQueue, fileName)
+}
+
+// 下载完成，文件从正在下载的队列移到已下载的队列，其它客户端不会看到两边都没有的中间状态
+func finishDowning(fileName string) {
+	isDowningMu.Lock()
+	defer isDowningMu.Unlock()
+	delete(isDowningQueue, fileName)
+	hasDownedQueue[fileName] = new(hasDowned)
+}
+
+// 已经下载完成的文件
+func downedFile(fileName string) (*hasDowned, bool) {
+	isDowningMu.Lock()
+	defer isDowningMu.Unlock()
+	fileData, ok := hasDownedQueue[fileName]
+	return fileData, ok
+}
+
 func InitRouters() {
 	r := gin.Default()
+	if err := r.SetTrustedProxies(nil); err != nil { //不信任X-Forwarded-For，ClientIP就是连接的对端地址，凭证据此核对
+		log.Println(err)
+	}
 	r.GET("/down", getPiece)
-	r.Run(":" + strconv.Itoa(cfg.ClientPort))
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(cfg.ClientPort),
+		Handler: r,
+	}
+	p2pMu.Lock()
+	if isStopping() {
+		p2pMu.Unlock()
+		return
+	}
+	p2pServer = srv
+	if cfg.MetricsAddr != "" {
+		metricsServer = serveMetrics(cfg.MetricsAddr)
+	}
+	p2pMu.Unlock()
+	err := srv.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("启动上传服务失败:", err)
+	}
 }
 
 // 检查分片是否存在，获取分片，返回分片，处理错误请求
+// 请求必须带着追踪器签发的、这个文件的访问凭证，range和Size必须正好是元数据中的某一个分片。
 // 分片的存在得分情况：1，客户端正在下载被请求的文件（细分，已经下载了被请求的分片or没有下载）；2，客户端已
 // 经下完了被请求的文件；3，客户端下完了被请求的文件，但是文件已经被删除or移动了。
 // 4，客户端没有被请求的文件。
 func getPiece(c *gin.Context) {
-	//上传限速
-	if !upLimitGet() {
-		c.JSON(400, gin.H{
-			"message": "上传限速",
-		})
-		return
-	}
-	defer upDown() //放回令牌
 	//获取客户端请求的文件名
 	var request struct {
 		FileName string `json:"file_name"`
@@ -67,6 +145,21 @@ func getPiece(c *gin.Context) {
 	}
 	fileName := request.FileName
 
+	//只给带着追踪器凭证的客户端提供分片
+	ticket := c.GetHeader(protocol.TicketHeader)
+	if ticket == "" {
+		c.JSON(401, gin.H{
+			"message": "缺少访问凭证",
+		})
+		return
+	}
+	if err = verifyTicket(ticket, fileName, c.ClientIP()); err != nil {
+		c.JSON(401, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+
 	fileRange := c.GetHeader("Range") //获取客户端请求的文件片段
 	//解析文件的range，获取开头
 	start, ok := getPieceStart(fileRange)
@@ -79,41 +172,80 @@ func getPiece(c *gin.Context) {
 
 	fileSize := c.GetHeader("Size")
 	size, err := strconv.Atoi(fileSize)
-	if err != nil {
+	if err != nil || size <= 0 {
 		c.JSON(400, gin.H{
 			"message": "Size格式错误",
 		})
 		return
 	}
 
-	//检查文件名是否存在各个文件列表中。
-	fileData, ok := isDowningQueue[fileName]
-	if ok {
-		filePiece, isExist := getIsDowningFilePiece(start, fileData)
-		if !isExist {
+	//检查文件名是否存在各个文件列表中，找到文件的元数据
+	fileData, downing := downingFile(fileName)
+	downed, hasDowned := downedFile(fileName)
+	var meta *god.Meta
+	switch {
+	case downing:
+		meta = fileData.meta
+	case hasDowned:
+		if meta, _, err = downed.load(fileName); err != nil {
+			log.Println("加载", fileName, "失败:", err)
 			c.JSON(400, gin.H{
-				"message": "分片不存在",
+				"message": "文件已移除",
 			})
 			return
 		}
-		c.Data(200, "application/octet-stream", filePiece)
+	default:
+		c.JSON(404, gin.H{
+			"message": "文件不存在",
+		})
 		return
 	}
-	_, ok = hasDownedQueue[fileName]
-	if ok {
-		filePiece, isExist := getHasDownedFilePiece(start, size, fileName)
-		if !isExist {
-			c.JSON(400, gin.H{
-				"message": "文件已移除",
-			})
-			return
-		}
-		c.Data(200, "application/octet-stream", filePiece)
+	//分片大小以本地的元数据为准，请求中的Size只用来核对，不能让对方决定要分配多大的内存
+	if want, ok := pieceSizeAt(meta, start); !ok || want != size {
+		c.JSON(400, gin.H{
+			"message": "range或Size与分片对不上",
+		})
 		return
 	}
-	c.JSON(404, gin.H{
-		"message": "文件不存在",
-	})
+
+	//上传限速，按分片大小占用额度
+	if !upLimitGet(size) {
+		c.JSON(400, gin.H{
+			"message": "上传限速",
+		})
+		return
+	}
+	defer upDown(size) //放回额度
+
+	var (
+		filePiece []byte
+		isExist   bool
+	)
+	if downing {
+		filePiece, isExist = getIsDowningFilePiece(start, fileData)
+	} else {
+		filePiece, isExist = getHasDownedFilePiece(start, size, fileName, downed)
+	}
+	if !isExist {
+		c.JSON(400, gin.H{
+			"message": "分片不存在",
+		})
+		return
+	}
+	c.Data(200, "application/octet-stream", filePiece)
+	bytesUploaded.Add(float64(len(filePiece)))
+}
+
+// 从start开始的分片的大小。start不是某个分片的开头时返回false
+func pieceSizeAt(meta *god.Meta, start int) (int, bool) {
+	if meta.PieceSize <= 0 || start < 0 || start%meta.PieceSize != 0 {
+		return 0, false
+	}
+	i := start / meta.PieceSize
+	if i >= len(meta.FilePieces) || meta.FilePieces[i].PieceStart != start {
+		return 0, false
+	}
+	return meta.FilePieces[i].PieceSize, true
 }
 
 func getIsDowningFilePiece(start int, fileData *isDowning) ([]byte, bool) {
@@ -134,12 +266,13 @@ func getIsDowningFilePiece(start int, fileData *isDowning) ([]byte, bool) {
 	return file, true
 }
 
-func getHasDownedFilePiece(start, size int, fileName string) ([]byte, bool) {
-	file, err := os.Open("./down/" + fileName)
+func getHasDownedFilePiece(start, size int, fileName string, downed *hasDowned) ([]byte, bool) {
+	//目录分享的分片可能跨越多个文件，需要元数据才能知道每个文件的位置
+	_, file, err := downed.load(fileName)
 	if err != nil {
+		log.Println("加载", fileName, "失败:", err)
 		return nil, false
 	}
-	defer file.Close()
 	filePiece := make([]byte, size)
 	_, err = file.ReadAt(filePiece, int64(start))
 	if err != nil {
@@ -181,75 +314,16 @@ func getPieceStart(fileRange string) (int, bool) {
 	return start, true
 }
 
-// 将已下载的文件列表传输到服务器上，同时初始化hasDownQueue
-func sendFileList() {
-	//初始化已下载文件队列
-	hasDownedQueue = make(map[string]struct{})
-
-	//获取已下载文件列表
-	type fileList struct {
-		FileName []string `json:"file_name"`
-	}
-	var fl fileList
-	files, err := os.ReadDir("./down")
-	if err != nil {
-		log.Fatalf("读取已下载文件列表失败：%v", err)
-	}
-
-	for _, file := range files {
-		fl.FileName = append(fl.FileName, file.Name())
-		hasDownedQueue[file.Name()] = struct{}{}
-	}
-
-	//将已下载文件列表传输到服务器上
-	u := "http://" + cfg.ServiceAdr + "/list"
-	encodeData, err := json.Marshal(fl)
-	if err != nil {
-		log.Fatalf("序列化文件列表失败:%v", err)
-	}
-
-	req, err := http.NewRequest("POST", u, bytes.NewBuffer(encodeData))
-	if err != nil {
-		log.Fatalf("创建请求失败:%v", err)
-	}
-
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Content-Length", strconv.Itoa(len(encodeData)))
-	req.Header.Set("User-Agent", "GDown")
-	req.Header.Set("X-User-Port", strconv.Itoa(cfg.ClientPort))
-
-	client := http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		log.Fatalf("发送请求失败:%v", err)
-	}
-
-	defer resp.Body.Close()
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		log.Fatalf("读取服务器回传信息失败:%v", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		log.Fatalf("服务器回传信息错误:%v", string(body))
-	}
-
-	//获取真实ip
-	type message struct {
-		Message string `json:"message"`
-		IpAdr   string `json:"ipAdr"`
-	}
-	var m message
-	err = json.Unmarshal(body, &m)
-	if err != nil {
-		log.Fatalf("获取真实ip失败:%v", err)
-	}
-	trueIpAdr = m.IpAdr
+// 服务器上的文件更新或删除之后，本地的文件就不能再提供给其它客户端了
+func forgetFile(fileName string) {
+	isDowningMu.Lock()
+	defer isDowningMu.Unlock()
+	delete(hasDownedQueue, fileName)
 }
 
 // 移除失效的客户端列表
-func (engine *downEngine) removeFallClient(index int) {
+func (engine *downEngine) removeFallClient(c *client) {
 	engine.clientMu.Lock()
 	defer engine.clientMu.Unlock()
-	engine.ipAdr = append(engine.ipAdr[:index], engine.ipAdr[index+1:]...)
+	engine.removeClient(c)
 }
@@ -0,0 +1,42 @@
+package cli
+
+import (
+	"Gdown/protocol"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"strings"
+)
+
+//客户端标识。第一次运行时随机生成并保存在peer_id文件中，之后一直使用同一个标识。
+//服务器据此识别客户端，而不是IP和端口，换了端口或者和别人共用一个公网IP都不受影响。
+
+const peerIDFile = "./peer_id"
+
+var peerID string //客户端标识，在与服务器建立连接之前加载
+
+// 读取客户端标识，不存在时生成一个新的
+func loadPeerID() (string, error) {
+	buf, err := os.ReadFile(peerIDFile)
+	if err == nil {
+		id := strings.TrimSpace(string(buf))
+		if protocol.ValidPeerID(id) {
+			return id, nil
+		}
+		return "", errors.New(peerIDFile + "内容不是合法的客户端标识，删除后会重新生成")
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	raw := make([]byte, 20)
+	if _, err = rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := hex.EncodeToString(raw)
+	if err = os.WriteFile(peerIDFile, []byte(id+"\n"), 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
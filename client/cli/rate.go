@@ -4,78 +4,80 @@ import (
 	"sync"
 )
 
-//限速器。采用令牌桶算法，读取配置文件，实现下载速度和上传速度的限制。
-//简单来说，配置文件配置速度/每块分片的大小，获得可以同时进行传输的分片数量，从而达到速率限制的效果
+//限速器。读取配置文件，实现下载速度和上传速度的限制。
+//简单来说，配置文件配置的速度就是同时在传输的分片的总字节数上限，从而达到速率限制的效果。
+//分片大小由每个文件的元数据决定，所以按字节计数，而不是按分片计数。
 
-// 上传速度限制器
-type upL struct {
-	upLimit int        //上传速度最大限制
-	upCount int        //已经在上传的分片数量
-	mu      sync.Mutex //并发安全
+// 限速器，记录正在传输的字节数
+type limiter struct {
+	limit int        //同时传输的最大字节数，为0时不限速
+	used  int        //正在传输的字节数
+	mu    sync.Mutex //并发安全
+	cond  *sync.Cond //等待其它分片传输完成
 }
 
 var (
-	downLimit chan struct{}
-	upLimit   upL
-) //下载速度限制
+	downLimit = newLimiter() //下载速度限制
+	upLimit   = newLimiter() //上传速度限制
+)
 
-const blockSize = 1024 * 1024 //每个分片的大小。服务器制造固定大小的分片，同步。
+func newLimiter() *limiter {
+	l := &limiter{}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
 
-// 限速器。读取配置文件，构造令牌桶。
+// 限速器。读取配置文件，设置上传和下载的上限。
 func limit() {
-	downRateLimit := cfg.DownRate
-	upRateLimit := cfg.UpRate
+	downLimit.setLimit(cfg.DownRate)
+	upLimit.setLimit(cfg.UpRate)
+}
 
-	//构造下载限速令牌桶
-	if downRateLimit != 0 {
-		downLimit = make(chan struct{}, downRateLimit/blockSize)
-	} else {
-		downLimit = nil
-	}
+// 修改上限，配置文件热修改时调用。正在传输的分片不受影响。
+func (l *limiter) setLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limit = limit
+	l.cond.Broadcast()
+}
 
-	//构造上传限速令牌桶
-	if upRateLimit != 0 {
-		upLimit.upLimit = upRateLimit / blockSize
-	} else {
-		upLimit.upLimit = 0
-	}
+// 判断再传输size字节是否会超过上限。单个分片比上限还大时，只要没有别的分片在传输就放行，避免永远等下去
+func (l *limiter) full(size int) bool {
+	return l.limit != 0 && l.used > 0 && l.used+size > l.limit
 }
 
-// 下载限速器。从令牌桶中取出一个令牌，如果没有令牌则阻塞。
-func downLimitGet() {
-	if downLimit != nil { //如果没有限速，则不启用令牌桶。
-		downLimit <- struct{}{} //取出一个令牌（在管道里塞一个，分片任务完成之后再取出来）
+// 下载限速器。占用size字节的额度，如果额度不够则阻塞。
+func downLimitGet(size int) {
+	downLimit.mu.Lock()
+	defer downLimit.mu.Unlock()
+	for downLimit.full(size) {
+		downLimit.cond.Wait()
 	}
+	downLimit.used += size
 }
 
-// 上传限速器。返回布尔，表示是否达到。
-func upLimitGet() bool {
-	if upLimit.upLimit == 0 { //如果没有限速
-		return true
-	} else {
-		upLimit.mu.Lock()
-		defer upLimit.mu.Unlock()
-		if upLimit.upCount < upLimit.upLimit { //如果没有达到限速
-			upLimit.upCount++
-			return true
-		} else { //如果达到限速
-			return false
-		}
+// 上传限速器。返回布尔，表示是否拿到了额度。
+func upLimitGet(size int) bool {
+	upLimit.mu.Lock()
+	defer upLimit.mu.Unlock()
+	if upLimit.full(size) { //如果达到限速
+		return false
 	}
+	upLimit.used += size
+	return true
 }
 
-// 取出下载限速器的令牌
-func downDown() { //这名字多少有点滑稽了，下载结束。
-	if downLimit != nil {
-		<-downLimit
-	}
+// 放回下载限速器的额度
+func downDown(size int) { //这名字多少有点滑稽了，下载结束。
+	downLimit.mu.Lock()
+	defer downLimit.mu.Unlock()
+	downLimit.used -= size
+	downLimit.cond.Broadcast()
 }
 
 // 同理
-func upDown() {
-	if upLimit.upLimit != 0 {
-		upLimit.mu.Lock()
-		defer upLimit.mu.Unlock()
-		upLimit.upCount--
-	}
+func upDown(size int) {
+	upLimit.mu.Lock()
+	defer upLimit.mu.Unlock()
+	upLimit.used -= size
 }
@@ -0,0 +1,178 @@
+package cli
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//登录状态。access token有效期很短，在它过期之前用refresh token换一对新的；
+//refresh token也失效了（过期或被注销）就用配置文件里的用户名密码重新登录。
+
+// 登录和刷新token时服务器的响应
+type tokenResponse struct {
+	Status       int    `json:"status"`
+	Message      string `json:"message"`
+	Token        string `json:"token"`         //access token
+	RefreshToken string `json:"refresh_token"` //旧版本服务器没有
+	ExpiresIn    int    `json:"expires_in"`    //access token多少秒后过期
+}
+
+var (
+	session struct {
+		mu        sync.Mutex
+		token     string
+		refresh   string
+		issuedAt  time.Time
+		expiresAt time.Time //为零时不需要续期
+	}
+	renewOnce sync.Once
+)
+
+var errRefreshRejected = errors.New("refresh token已失效")
+
+// 当前的access token
+func accessToken() string {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	return session.token
+}
+
+// 给发往服务器的请求加上access token。其它客户端不需要也不应该拿到token，不能用在p2p请求上
+func authorize(req *http.Request) {
+	req.Header.Set("Authorization", accessToken())
+}
+
+// 保存服务器签发的token
+func setTokens(resp tokenResponse) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	session.token = resp.Token
+	session.refresh = resp.RefreshToken
+	session.issuedAt = time.Now()
+	session.expiresAt = time.Time{}
+	if resp.ExpiresIn > 0 && resp.RefreshToken != "" {
+		session.expiresAt = session.issuedAt.Add(time.Duration(resp.ExpiresIn) * time.Second)
+	}
+}
+
+// 下一次续期的时间：有效期过去五分之四的时候
+func renewAt() (time.Time, bool) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.expiresAt.IsZero() {
+		return time.Time{}, false
+	}
+	return session.expiresAt.Add(-session.expiresAt.Sub(session.issuedAt) / 5), true
+}
+
+// 在access token过期前自动续期，直到客户端退出
+func renewLoop() {
+	for {
+		wait := time.Minute //旧版本服务器的token不需要续期，隔一会儿再看看有没有重新登录
+		if at, ok := renewAt(); ok {
+			wait = time.Until(at)
+		}
+		select {
+		case <-stopping:
+			return
+		case <-time.After(wait):
+		}
+		if _, ok := renewAt(); !ok {
+			continue
+		}
+		err := refreshTokens()
+		if errors.Is(err, errRefreshRejected) {
+			log.Println("refresh token已失效，重新登录")
+			if resp, ok := requestLogin(); ok {
+				setTokens(resp)
+				continue
+			}
+		} else if err == nil {
+			continue
+		} else {
+			log.Println("刷新token失败:", err)
+		}
+		select { //稍后重试
+		case <-stopping:
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// 用refresh token换一对新的token
+func refreshTokens() error {
+	session.mu.Lock()
+	refresh := session.refresh
+	session.mu.Unlock()
+	var response tokenResponse
+	code, err := postSession("/user/refresh", "", refresh, &response)
+	if err != nil {
+		return err
+	}
+	if code == http.StatusUnauthorized {
+		return errRefreshRejected
+	}
+	if code != http.StatusOK {
+		return errors.New(strconv.Itoa(code) + ":" + response.Message)
+	}
+	setTokens(response)
+	return nil
+}
+
+// 退出登录，让服务器注销当前的token
+func logout() {
+	session.mu.Lock()
+	token, refresh := session.token, session.refresh
+	session.token, session.refresh, session.expiresAt = "", "", time.Time{}
+	session.mu.Unlock()
+	if token == "" {
+		return
+	}
+	var response tokenResponse
+	code, err := postSession("/user/logout", token, refresh, &response)
+	if err != nil {
+		log.Println("退出登录失败:", err)
+		return
+	}
+	if code != http.StatusOK {
+		log.Println("退出登录失败:", code, response.Message)
+	}
+}
+
+// 向服务器发送refresh token，解析响应
+func postSession(path, token, refresh string, response *tokenResponse) (int, error) {
+	buf, err := json.Marshal(struct {
+		RefreshToken string `json:"refresh_token"`
+	}{refresh})
+	if err != nil {
+		return 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", "http://"+cfg.ServiceAdr+path, bytes.NewBuffer(buf))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GDown")
+	if token != "" {
+		req.Header.Set("Authorization", token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if err = json.NewDecoder(resp.Body).Decode(response); err != nil {
+		return resp.StatusCode, err
+	}
+	return resp.StatusCode, nil
+}
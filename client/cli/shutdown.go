@@ -0,0 +1,90 @@
+package cli
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+//优雅退出。不再开始新的下载、不再接受其它客户端的请求，等正在传输的分片完成、保存下载进度，
+//最后向服务器发送websocket关闭帧，服务器立刻就能把这个客户端移除，不用等心跳超时，再注销token。
+
+const shutdownTimeout = 15 * time.Second //等待正在传输的分片的最长时间
+
+var (
+	stopping      = make(chan struct{}) //退出时关闭，通知各个下载任务暂停
+	stopOnce      sync.Once
+	tasks         sync.WaitGroup //正在进行的下载任务
+	p2pServer     *http.Server   //上传服务
+	metricsServer *http.Server   //监控指标服务
+	p2pMu         sync.Mutex
+)
+
+// 是否正在退出
+func isStopping() bool {
+	select {
+	case <-stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Shutdown 优雅退出，可以重复调用
+func Shutdown() {
+	stopOnce.Do(func() {
+		log.Println("正在退出，等待正在传输的分片完成")
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		close(stopping)
+
+		//不再接受上传请求，等正在上传的分片发送完
+		p2pMu.Lock()
+		srv := p2pServer
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+		p2pMu.Unlock()
+		if srv != nil {
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Println("等待上传完成超时:", err)
+			}
+		}
+
+		//等下载任务保存进度
+		done := make(chan struct{})
+		go func() {
+			tasks.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-ctx.Done():
+			log.Println("等待下载任务超时，部分进度可能没有保存")
+		}
+
+		closeServerConn()
+		logout()
+		log.Println("已退出")
+	})
+}
+
+// 向服务器发送关闭帧并断开websocket
+func closeServerConn() {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if server.conn == nil {
+		return
+	}
+	msg := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "客户端退出")
+	err := server.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	if err != nil {
+		log.Println("发送关闭帧失败:", err)
+	}
+	server.conn.Close()
+	server.conn = nil
+}
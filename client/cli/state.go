@@ -0,0 +1,100 @@
+package cli
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"strconv"
+)
+
+//下载进度。退出时写入./temp/<文件名>.state，下次下载同一个文件时跳过已经写入临时文件的分片。
+//临时文件在读回来的时候重新校验，退出时没写完的分片会被重新下载。
+
+// 下载进度
+type downState struct {
+	FileName string `json:"file_name"`
+	Root     string `json:"root"`   //元数据的默克尔根，文件在服务器上更新之后进度作废
+	Pieces   []int  `json:"pieces"` //已经写入临时文件的分片
+}
+
+func statePath(fileName string) string {
+	return "./temp/" + fileName + ".state"
+}
+
+// 保存下载进度，先写临时文件再重命名，退出过程中被打断也不会留下写了一半的进度文件
+func (engine *downEngine) saveState() {
+	engine.mu.Lock()
+	state := downState{FileName: engine.fileName, Root: engine.fileInfo.ID(), Pieces: make([]int, 0, len(engine.fileQueue))}
+	for _, f := range engine.fileQueue {
+		state.Pieces = append(state.Pieces, f.index)
+	}
+	engine.mu.Unlock()
+
+	buf, err := json.Marshal(state)
+	if err == nil {
+		err = os.WriteFile(statePath(engine.fileName)+".tmp", buf, 0666)
+	}
+	if err == nil {
+		err = os.Rename(statePath(engine.fileName)+".tmp", statePath(engine.fileName))
+	}
+	if err != nil {
+		log.Println(engine.fileName, "保存下载进度失败:", err)
+		return
+	}
+	log.Println(engine.fileName, "已保存下载进度，已下载", len(state.Pieces), "/", engine.fileInfo.FilePiecesNum, "个分片")
+}
+
+// 读取上次的下载进度，校验通过的分片直接算作已下载。返回已下载的分片
+func (engine *downEngine) loadState() map[int]bool {
+	done := make(map[int]bool)
+	buf, err := os.ReadFile(statePath(engine.fileName))
+	if errors.Is(err, fs.ErrNotExist) {
+		return done
+	}
+	var state downState
+	if err == nil {
+		err = json.Unmarshal(buf, &state)
+	}
+	if err != nil {
+		log.Println(engine.fileName, "读取下载进度失败，重新下载:", err)
+		return done
+	}
+	if state.Root != engine.fileInfo.ID() {
+		log.Println(engine.fileName, "已在服务器更新，上次的下载进度作废")
+		engine.removeState()
+		return done
+	}
+
+	restored := make([]int, 0, len(state.Pieces))
+	for _, index := range state.Pieces {
+		if index < 0 || index >= engine.fileInfo.FilePiecesNum || done[index] {
+			continue
+		}
+		name := "./temp/" + engine.fileName + strconv.Itoa(index) + ".tmp"
+		data, err := os.ReadFile(name)
+		if err != nil || engine.fileInfo.HashAlgo.Sum(data) != engine.fileInfo.FilePieces[index].PieceHash {
+			continue
+		}
+		done[index] = true
+		engine.fileQueue = append(engine.fileQueue, tempFileInfo{index, name})
+		engine.successNum++
+		restored = append(restored, index)
+	}
+	if len(restored) != 0 {
+		engine.havePiece(restored...) //一条have带上所有恢复的分片，不用每片发一条
+	}
+	if len(done) != 0 {
+		log.Println(engine.fileName, "继续上次的下载，已下载", len(done), "/", engine.fileInfo.FilePiecesNum, "个分片")
+	}
+	return done
+}
+
+// 删除下载进度
+func (engine *downEngine) removeState() {
+	err := os.Remove(statePath(engine.fileName))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println(engine.fileName, "删除下载进度失败:", err)
+	}
+}
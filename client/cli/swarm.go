@@ -0,0 +1,82 @@
+package cli
+
+import (
+	"Gdown/protocol"
+	"sync"
+)
+
+//正在进行的下载任务。服务器通过websocket推送swarm中客户端的变化，转交给对应文件的下载引擎，
+//下载过程中也能用上新加入的客户端，离开的客户端不再请求。
+
+var (
+	engines   = make(map[string]*downEngine) //文件名 -> 下载引擎
+	enginesMu sync.Mutex
+)
+
+// 登记下载任务，开始接收客户端变化
+func registerEngine(engine *downEngine) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	engines[engine.fileName] = engine
+}
+
+// 注销下载任务
+func unregisterEngine(engine *downEngine) {
+	enginesMu.Lock()
+	defer enginesMu.Unlock()
+	if engines[engine.fileName] == engine {
+		delete(engines, engine.fileName)
+	}
+}
+
+// 把服务器推送的客户端变化交给对应的下载任务，没有在下载这个文件时忽略
+func updatePeers(delta protocol.Peers) {
+	enginesMu.Lock()
+	engine, ok := engines[delta.FileName]
+	enginesMu.Unlock()
+	if ok {
+		engine.updatePeers(delta)
+	}
+}
+
+// 更新客户端列表。已有的客户端更新分片记录，新客户端加入列表，离开的客户端移出列表
+func (engine *downEngine) updatePeers(delta protocol.Peers) {
+	self := selfAdr()
+	engine.clientMu.Lock()
+	defer engine.clientMu.Unlock()
+	for _, p := range delta.Added {
+		if p.Addr == self {
+			continue
+		}
+		if c := engine.findClient(p.Addr); c != nil {
+			c.pieces = p.Bitfield
+			continue
+		}
+		engine.ipAdr = append(engine.ipAdr, &client{IPAdr: p.Addr, pieces: p.Bitfield})
+	}
+	for _, addr := range delta.Removed {
+		if c := engine.findClient(addr); c != nil {
+			engine.removeClient(c)
+		}
+	}
+}
+
+// 按地址查找客户端，不包括服务器。调用方需持有clientMu
+func (engine *downEngine) findClient(addr string) *client {
+	for _, c := range engine.ipAdr {
+		if c.IPAdr == addr && !c.isServer {
+			return c
+		}
+	}
+	return nil
+}
+
+// 移除客户端，不在列表中时什么都不做。调用方需持有clientMu
+func (engine *downEngine) removeClient(c *client) {
+	for i, v := range engine.ipAdr {
+		if v == c {
+			engine.ipAdr = append(engine.ipAdr[:i], engine.ipAdr[i+1:]...)
+			return
+		}
+	}
+}
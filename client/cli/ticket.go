@@ -0,0 +1,124 @@
+package cli
+
+import (
+	"Gdown/protocol"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//p2p访问凭证。向其它客户端请求分片时带上追踪器签发的凭证；
+//收到其它客户端的请求时，用服务器在welcome中给的公钥验证凭证，确认对方是登录过的用户。
+
+const ticketRenewBefore = time.Minute //凭证剩余有效期少于这个时间时换新的
+
+var trackerKey struct {
+	mu  sync.Mutex
+	key ed25519.PublicKey
+}
+
+// 保存追踪器的公钥
+func setTrackerKey(key []byte) {
+	trackerKey.mu.Lock()
+	defer trackerKey.mu.Unlock()
+	if len(key) != ed25519.PublicKeySize {
+		log.Println("服务器的凭证公钥格式错误")
+		trackerKey.key = nil
+		return
+	}
+	trackerKey.key = key
+}
+
+// 验证其它客户端带来的凭证，凭证必须是发给请求来源IP、用于下载这个文件的
+func verifyTicket(s, fileName, host string) error {
+	trackerKey.mu.Lock()
+	key := trackerKey.key
+	trackerKey.mu.Unlock()
+	if key == nil {
+		return errors.New("尚未从服务器获取凭证公钥")
+	}
+	t, err := protocol.VerifyTicket(s, key, time.Now())
+	if err != nil {
+		return err
+	}
+	if t.FileName != fileName || t.Host != host {
+		return protocol.ErrTicketInvalid
+	}
+	return nil
+}
+
+// 下载任务持有的凭证
+type downTicket struct {
+	mu      sync.Mutex
+	ticket  string
+	expires time.Time
+}
+
+func (t *downTicket) set(ticket string, expires int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.ticket = ticket
+	t.expires = time.Unix(expires, 0)
+}
+
+// 当前可用的凭证，快过期时先向服务器换新的。换不到时返回旧的，让对方拒绝
+func (engine *downEngine) currentTicket() string {
+	t := &engine.ticket
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if time.Until(t.expires) > ticketRenewBefore {
+		return t.ticket
+	}
+	ticket, expires, err := requestTicket(engine.fileName)
+	if err != nil {
+		log.Println("更新", engine.fileName, "的访问凭证失败:", err)
+		return t.ticket
+	}
+	t.ticket = ticket
+	t.expires = time.Unix(expires, 0)
+	return t.ticket
+}
+
+// 向服务器请求新的凭证
+func requestTicket(fileName string) (string, int64, error) {
+	buf, err := json.Marshal(struct {
+		FileName string `json:"file_name"`
+	}{fileName})
+	if err != nil {
+		return "", 0, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://"+cfg.ServiceAdr+"/ticket", bytes.NewBuffer(buf))
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "GDown")
+	req.Header.Set("X-Peer-ID", peerID)
+	authorize(req)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", 0, err
+	}
+	defer resp.Body.Close()
+	var response struct {
+		Message       string `json:"message"`
+		Ticket        string `json:"ticket"`
+		TicketExpires int64  `json:"ticket_expires"`
+	}
+	if err = json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return "", 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", 0, errors.New(strconv.Itoa(resp.StatusCode) + ":" + response.Message)
+	}
+	return response.Ticket, response.TicketExpires, nil
+}
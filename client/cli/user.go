@@ -58,8 +58,19 @@ func Register() {
 	log.Println("注册成功")
 }
 
-// 登录
+// 登录，成功后保存token并连接服务器，之后在access token过期前自动续期
 func Login() {
+	resp, ok := requestLogin()
+	if !ok {
+		return
+	}
+	setTokens(resp)
+	renewOnce.Do(func() { go renewLoop() })
+	connect() //自动进行连接
+}
+
+// 向服务器发送用户名和密码，换取token
+func requestLogin() (tokenResponse, bool) {
 	//获取用户登录信息
 	type loginInfo struct {
 		Username string `json:"username"`
@@ -73,7 +84,7 @@ func Login() {
 	buf, err := json.Marshal(login)
 	if err != nil {
 		log.Println("序列化用户登录信息错误:", err)
-		return
+		return tokenResponse{}, false
 	}
 
 	//发送登录信息
@@ -85,27 +96,20 @@ func Login() {
 	resp, err := client.Do(req)
 	if err != nil {
 		log.Println("发送登录信息错误:", err)
-		return
+		return tokenResponse{}, false
 	}
 
 	//解析服务器回传信息
 	defer resp.Body.Close()
-	var response struct {
-		Status  int    `json:"status"`
-		Message string `json:"message"`
-		Token   string `json:"token"`
-	}
+	var response tokenResponse
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
 		log.Println("解析服务器回传信息错误:", err)
-		return
+		return tokenResponse{}, false
 	}
 	if response.Status != http.StatusOK {
 		log.Println("登录失败:", response.Message)
-		return
+		return tokenResponse{}, false
 	}
-
-	//保存token
-	cfg.token = response.Token
-	connect() //自动进行连接
+	return response, true
 }
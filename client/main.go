@@ -2,21 +2,59 @@ package main
 
 import (
 	"Gdown/client/cli"
+	"bufio"
+	"context"
 	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
 )
 
+// 所有输入都从这里读，混用fmt.Scanln会丢掉缓冲区里已经读到的内容
+var stdin = bufio.NewReader(os.Stdin)
+
+// 读取一整行，去掉首尾空白。关键字里可以带空格
+func readLine() (string, error) {
+	line, err := stdin.ReadString('\n')
+	if err != nil && line == "" {
+		return "", err
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// 读取一个整数
+func readInt() (int, error) {
+	line, err := readLine()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(line)
+}
+
 // 客户端启动
 func main() {
+	//Ctrl+C或者SIGTERM时也要保存下载进度再退出
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		<-ctx.Done()
+		stop()
+		cli.Shutdown()
+		os.Exit(0)
+	}()
+
 	const (
 		register = 1
 		login    = 2
 		download = 3
-		exit     = 4
+		list     = 4
+		exit     = 5
 	)
 	for {
-		fmt.Println("1.注册\n2.登录\n3.下载\n4.退出")
-		var choice int
-		_, err := fmt.Scanln(&choice)
+		fmt.Println("1.注册\n2.登录\n3.下载\n4.文件列表\n5.退出")
+		choice, err := readInt()
 		if err != nil {
 			fmt.Println("错误输入")
 			continue
@@ -31,15 +69,31 @@ func main() {
 			go cli.InitRouters()
 			go cli.DownControl()
 		case download:
-			var filename string
-			fmt.Println("请输入要下载的文件名:")
-			_, err := fmt.Scanln(&filename)
-			if err != nil {
+			fmt.Println("请输入要下载的文件名（可以写成 文件名@默克尔根，核对文件身份）:")
+			filename, err := readLine()
+			if err != nil || filename == "" {
 				fmt.Println("错误输入")
 				continue
 			}
 			cli.DownChan <- filename
+		case list:
+			cli.ReadConfig()
+			fmt.Println("请输入文件名关键字（直接回车列出全部）:")
+			keyword, _ := readLine() //读取失败时keyword为空，当作不过滤处理
+			for page := 1; ; {
+				pages := cli.ListFiles(keyword, page)
+				if pages <= 1 {
+					break
+				}
+				fmt.Println("请输入页码（0返回）:")
+				var err error
+				page, err = readInt()
+				if err != nil || page <= 0 || page > pages {
+					break
+				}
+			}
 		case exit:
+			cli.Shutdown()
 			return
 		default:
 			fmt.Println("错误的输入")
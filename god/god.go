@@ -0,0 +1,239 @@
+// Package god 定义.god元数据文件（“种子文件”）的格式，服务端写入，客户端读取。
+//
+// 文件由定长头部和JSON正文组成，头部各字段均为大端序：
+//
+//	偏移  长度  含义
+//	0     4     魔数 "GDWN"
+//	4     2     格式版本
+//	6     1     哈希算法编号
+//	7     1     保留，置0
+//	8     4     分片大小
+//	12    4     正文长度
+//	16    n     JSON正文
+//
+// 正文是普通的JSON，非Go的工具跳过16字节头部即可直接解析。
+// 早期版本直接用gob写入结构体，没有头部，读取时会自动迁移。
+//
+// 版本历史：
+//
+//	1  头部 + JSON正文
+//	2  正文增加merkle_root，分片默认使用sha256
+//	3  正文增加files，支持目录分享
+//	4  默克尔树的叶子加上0x00前缀，与内部节点区分
+package god
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Version 当前的格式版本
+const Version uint16 = 4
+
+const headerSize = 16
+
+// 正文长度上限。头部的长度字段不可信，超过上限的直接拒绝，避免按伪造的长度分配内存
+const maxBodySize = 256 << 20
+
+var magic = [4]byte{'G', 'D', 'W', 'N'}
+
+var (
+	ErrBadFormat          = errors.New("元数据格式错误")
+	ErrUnsupportedVersion = errors.New("不支持的元数据版本")
+	ErrUnsupportedHash    = errors.New("不支持的哈希算法")
+)
+
+// Meta 文件元数据
+type Meta struct {
+	Version   uint16   `json:"-"` //格式版本，读取时由头部填入
+	HashAlgo  HashAlgo `json:"-"` //分片哈希算法
+	PieceSize int      `json:"-"` //分片大小，最后一片可能更小
+
+	FileName      string   `json:"file_name"`
+	FileSize      int      `json:"file_size"`
+	FilePiecesNum int      `json:"file_pieces_num"`
+	FilePieces    []*Piece `json:"file_pieces"`
+	MerkleRoot    string   `json:"merkle_root,omitempty"` //默克尔根（十六进制），版本2起必填
+	ModTime       int64    `json:"mod_time,omitempty"`    //生成元数据时源文件的修改时间（Unix纳秒），服务端据此判断文件是否变动
+	Files         []*Entry `json:"files,omitempty"`       //目录分享时，目录下的各个文件。为空表示单个文件
+}
+
+// Entry 目录分享中的一个文件。目录下的所有文件按路径顺序首尾相接，看作一个大文件进行分片，分片可以跨越文件边界
+type Entry struct {
+	Path   string `json:"path"`   //相对于分享目录的路径，以/分隔
+	Size   int    `json:"size"`   //文件大小
+	Offset int    `json:"offset"` //文件在整个分享中的起始位置
+}
+
+// Piece 分片信息
+type Piece struct {
+	PieceIndex int    `json:"index"` //第几片
+	PieceStart int    `json:"start"` //记录分片处在文件的起始位置
+	PieceSize  int    `json:"size"`  //分片的大小
+	PieceHash  string `json:"hash"`  //分片的哈希值（十六进制），用于校验
+}
+
+// Encode 将元数据按当前版本写入w
+func Encode(w io.Writer, m *Meta) error {
+	if m.Version != 0 && m.Version != Version {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, m.Version)
+	}
+	if !m.HashAlgo.Valid() {
+		return fmt.Errorf("%w: %d", ErrUnsupportedHash, m.HashAlgo)
+	}
+	if m.PieceSize <= 0 || uint64(m.PieceSize) > 0xFFFFFFFF {
+		return fmt.Errorf("%w: 分片大小%d", ErrBadFormat, m.PieceSize)
+	}
+	root, err := m.Root()
+	if err != nil {
+		return err
+	}
+	if m.MerkleRoot == "" {
+		m.MerkleRoot = root
+	} else if m.MerkleRoot != root {
+		return fmt.Errorf("%w: 默克尔根与分片表不一致", ErrBadFormat)
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	var header [headerSize]byte
+	copy(header[0:4], magic[:])
+	binary.BigEndian.PutUint16(header[4:6], Version)
+	header[6] = byte(m.HashAlgo)
+	binary.BigEndian.PutUint32(header[8:12], uint32(m.PieceSize))
+	binary.BigEndian.PutUint32(header[12:16], uint32(len(body)))
+
+	if _, err = w.Write(header[:]); err != nil {
+		return err
+	}
+	_, err = w.Write(body)
+	return err
+}
+
+// Decode 从r读取元数据。未知版本会返回ErrUnsupportedVersion，旧版gob文件会被迁移。
+// 版本2起会校验默克尔根与分片表是否一致。
+func Decode(r io.Reader) (*Meta, error) {
+	br := bufio.NewReader(r)
+	head, err := br.Peek(len(magic))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	if !bytes.Equal(head, magic[:]) {
+		return decodeGob(br)
+	}
+
+	var header [headerSize]byte
+	if _, err = io.ReadFull(br, header[:]); err != nil {
+		return nil, fmt.Errorf("%w: 头部不完整", ErrBadFormat)
+	}
+	var m Meta
+	m.Version = binary.BigEndian.Uint16(header[4:6])
+	if m.Version == 0 || m.Version > Version {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, m.Version)
+	}
+	m.HashAlgo = HashAlgo(header[6])
+	if !m.HashAlgo.Valid() {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedHash, m.HashAlgo)
+	}
+	m.PieceSize = int(binary.BigEndian.Uint32(header[8:12]))
+	bodyLen := int64(binary.BigEndian.Uint32(header[12:16]))
+	if bodyLen > maxBodySize {
+		return nil, fmt.Errorf("%w: 正文长度%d超过上限", ErrBadFormat, bodyLen)
+	}
+
+	//按实际读到的数据分配内存，而不是一次分配头部声称的长度
+	body, err := io.ReadAll(io.LimitReader(br, bodyLen))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) != bodyLen {
+		return nil, fmt.Errorf("%w: 正文不完整", ErrBadFormat)
+	}
+	if err = json.Unmarshal(body, &m); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrBadFormat, err)
+	}
+	if err = m.validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// ReadFile 读取元数据文件
+func ReadFile(path string) (*Meta, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return Decode(f)
+}
+
+// WriteFile 写入元数据文件。先写临时文件再重命名，避免写到一半留下损坏的文件。
+func WriteFile(path string, m *Meta) error {
+	var buf bytes.Buffer
+	if err := Encode(&buf, m); err != nil {
+		return err
+	}
+	//临时文件名各不相同，同一个文件同时写两次时不会写到一起
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err == nil {
+		err = f.Chmod(0644)
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+// 检查分片表与文件大小是否对得上
+func (m *Meta) validate() error {
+	if m.PieceSize <= 0 {
+		return fmt.Errorf("%w: 分片大小%d", ErrBadFormat, m.PieceSize)
+	}
+	if m.FilePiecesNum != len(m.FilePieces) {
+		return fmt.Errorf("%w: 分片数目不一致", ErrBadFormat)
+	}
+	next := 0
+	for i, p := range m.FilePieces {
+		if p == nil || p.PieceIndex != i || p.PieceStart != next || p.PieceSize <= 0 || len(p.PieceHash) != m.HashAlgo.Size()*2 {
+			return fmt.Errorf("%w: 第%d片信息错误", ErrBadFormat, i)
+		}
+		next += p.PieceSize
+	}
+	if next != m.FileSize {
+		return fmt.Errorf("%w: 分片总大小与文件大小不一致", ErrBadFormat)
+	}
+	if err := m.validateFiles(); err != nil {
+		return err
+	}
+	if m.Version < 2 {
+		return nil //版本1没有默克尔根
+	}
+	root, err := m.Root()
+	if err != nil {
+		return err
+	}
+	if m.MerkleRoot == "" || m.MerkleRoot != root {
+		return fmt.Errorf("%w: 默克尔根校验失败", ErrBadFormat)
+	}
+	return nil
+}
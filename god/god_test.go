@@ -0,0 +1,299 @@
+package god_test
+
+import (
+	"Gdown/god"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"testing"
+)
+
+func testMeta() *god.Meta {
+	data := []byte("hello gdown")
+	m := &god.Meta{
+		HashAlgo:      god.HashCRC32,
+		PieceSize:     8,
+		FileName:      "hello.txt",
+		FileSize:      len(data),
+		FilePiecesNum: 2,
+	}
+	m.FilePieces = []*god.Piece{
+		{PieceIndex: 0, PieceStart: 0, PieceSize: 8, PieceHash: m.HashAlgo.Sum(data[:8])},
+		{PieceIndex: 1, PieceStart: 8, PieceSize: 3, PieceHash: m.HashAlgo.Sum(data[8:])},
+	}
+	return m
+}
+
+func TestRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := god.Encode(&buf, testMeta()); err != nil {
+		t.Fatal(err)
+	}
+	m, err := god.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Version != god.Version || m.PieceSize != 8 || m.FilePiecesNum != 2 || m.FilePieces[1].PieceHash != testMeta().FilePieces[1].PieceHash {
+		t.Fatalf("解析结果不一致：%+v", m)
+	}
+}
+
+func TestUnknownVersion(t *testing.T) {
+	var buf bytes.Buffer
+	if err := god.Encode(&buf, testMeta()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+	binary.BigEndian.PutUint16(data[4:6], god.Version+1)
+	if _, err := god.Decode(bytes.NewReader(data)); !errors.Is(err, god.ErrUnsupportedVersion) {
+		t.Fatalf("期望版本错误，得到：%v", err)
+	}
+
+	m := testMeta()
+	m.Version = god.Version + 1
+	if err := god.Encode(&buf, m); !errors.Is(err, god.ErrUnsupportedVersion) {
+		t.Fatalf("期望版本错误，得到：%v", err)
+	}
+}
+
+func TestBodyLength(t *testing.T) {
+	var buf bytes.Buffer
+	if err := god.Encode(&buf, testMeta()); err != nil {
+		t.Fatal(err)
+	}
+	data := buf.Bytes()
+
+	//头部声称的长度超过上限
+	huge := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(huge[12:16], 0xFFFFFFFF)
+	if _, err := god.Decode(bytes.NewReader(huge)); !errors.Is(err, god.ErrBadFormat) {
+		t.Fatalf("期望格式错误，得到：%v", err)
+	}
+
+	//头部声称的长度比实际正文长
+	short := append([]byte(nil), data...)
+	binary.BigEndian.PutUint32(short[12:16], uint32(len(data)))
+	if _, err := god.Decode(bytes.NewReader(short)); !errors.Is(err, god.ErrBadFormat) {
+		t.Fatalf("期望格式错误，得到：%v", err)
+	}
+}
+
+func TestLegacyGob(t *testing.T) {
+	type Piece struct {
+		PieceIndex int
+		PieceStart int
+		PieceSize  int
+		PieceHash  uint32
+	}
+	type FileInfo struct {
+		FileName      string
+		FilePiecesNum int
+		FileSize      int
+		FilePieces    []*Piece
+	}
+	old := FileInfo{
+		FileName:      "old.bin",
+		FilePiecesNum: 1,
+		FileSize:      3,
+		FilePieces:    []*Piece{{PieceIndex: 0, PieceStart: 0, PieceSize: 3, PieceHash: 0x352441c2}},
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(old); err != nil {
+		t.Fatal(err)
+	}
+	m, err := god.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.HashAlgo != god.HashCRC32 || m.FilePieces[0].PieceHash != "352441c2" || m.FilePieces[0].PieceHash != m.HashAlgo.Sum([]byte("abc")) {
+		t.Fatalf("迁移结果不一致：%+v", m.FilePieces[0])
+	}
+}
+
+func TestMerkleRoot(t *testing.T) {
+	m := testMeta()
+	m.HashAlgo = god.HashSHA256
+	m.FilePieces[0].PieceHash = m.HashAlgo.Sum([]byte("hello gd"))
+	m.FilePieces[1].PieceHash = m.HashAlgo.Sum([]byte("own"))
+	var buf bytes.Buffer
+	if err := god.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	if m.ID() == "" {
+		t.Fatal("编码后没有填入默克尔根")
+	}
+
+	//篡改任意一片的哈希值，默克尔根都应校验失败
+	data := bytes.Replace(buf.Bytes(), []byte(m.FilePieces[1].PieceHash), []byte(m.HashAlgo.Sum([]byte("bad"))), 1)
+	if _, err := god.Decode(bytes.NewReader(data)); !errors.Is(err, god.ErrBadFormat) {
+		t.Fatalf("期望默克尔根校验失败，得到：%v", err)
+	}
+}
+
+func TestMerkleLeafPrefix(t *testing.T) {
+	m := testMeta()
+	m.HashAlgo = god.HashSHA256
+	m.FilePieces[0].PieceHash = m.HashAlgo.Sum([]byte("hello gd"))
+	m.FilePieces[1].PieceHash = m.HashAlgo.Sum([]byte("own"))
+	a, _ := hex.DecodeString(m.FilePieces[0].PieceHash)
+	b, _ := hex.DecodeString(m.FilePieces[1].PieceHash)
+	node := func(prefix byte, parts ...[]byte) []byte {
+		h := sha256.New()
+		h.Write([]byte{prefix})
+		for _, p := range parts {
+			h.Write(p)
+		}
+		return h.Sum(nil)
+	}
+
+	//当前版本：叶子带0x00前缀
+	want := hex.EncodeToString(node(0x01, node(0x00, a), node(0x00, b)))
+	if root, _ := god.MerkleRoot([]string{m.FilePieces[0].PieceHash, m.FilePieces[1].PieceHash}); root != want {
+		t.Fatalf("默克尔根错误：%s，期望%s", root, want)
+	}
+
+	//版本3的文件按旧规则校验，仍然可以读取
+	var buf bytes.Buffer
+	if err := god.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	legacy := hex.EncodeToString(node(0x01, a, b))
+	data := bytes.Replace(buf.Bytes(), []byte(m.ID()), []byte(legacy), 1)
+	binary.BigEndian.PutUint16(data[4:6], 3)
+	old, err := god.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.ID() != legacy {
+		t.Fatalf("旧版本的默克尔根错误：%s", old.ID())
+	}
+}
+
+func TestShareAcrossFiles(t *testing.T) {
+	data := []byte("abcdefghij")
+	m := &god.Meta{
+		HashAlgo:      god.HashSHA256,
+		PieceSize:     4,
+		FileName:      "dir",
+		FileSize:      len(data),
+		FilePiecesNum: 3,
+		Files: []*god.Entry{
+			{Path: "a.txt", Size: 3, Offset: 0},
+			{Path: "empty", Size: 0, Offset: 3},
+			{Path: "sub/b.txt", Size: 7, Offset: 3},
+		},
+	}
+	for i := 0; i < 3; i++ {
+		end := i*4 + 4
+		if end > len(data) {
+			end = len(data)
+		}
+		m.FilePieces = append(m.FilePieces, &god.Piece{PieceIndex: i, PieceStart: i * 4, PieceSize: end - i*4, PieceHash: m.HashAlgo.Sum(data[i*4 : end])})
+	}
+	var buf bytes.Buffer
+	if err := god.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := god.Decode(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	root := t.TempDir() + "/dir"
+	w, err := god.Create(root, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, p := range m.FilePieces { //每一片都跨越或者贴着文件边界
+		if _, err = w.WriteAt(data[p.PieceStart:p.PieceStart+p.PieceSize], int64(p.PieceStart)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w.Close()
+
+	r, err := god.Open(root, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	got := make([]byte, 5)
+	if _, err = r.ReadAt(got, 1); err != nil || string(got) != "bcdef" {
+		t.Fatalf("跨文件读取错误：%q %v", got, err)
+	}
+}
+
+// 目录里的文件再多，分享也不会一直占着它们的句柄
+func TestShareOpensLazily(t *testing.T) {
+	fds := func() int {
+		entries, err := os.ReadDir("/proc/self/fd")
+		if err != nil {
+			t.Skip("无法统计打开的文件：", err)
+		}
+		return len(entries)
+	}
+	m := &god.Meta{FileName: "many"}
+	for i := 0; i < 500; i++ {
+		m.Files = append(m.Files, &god.Entry{Path: fmt.Sprintf("f%03d", i), Size: 2, Offset: i * 2})
+	}
+	m.FileSize = 1000
+
+	root := t.TempDir() + "/many"
+	before := fds()
+	w, err := god.Create(root, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.WriteAt(bytes.Repeat([]byte("x"), m.FileSize), 0); err != nil {
+		t.Fatal(err)
+	}
+	r, err := god.Open(root, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err = r.ReadAt(got, 997); err != io.EOF {
+		t.Fatalf("读到分享末尾之后应该返回io.EOF，实际%v", err)
+	}
+	if _, err = r.ReadAt(got, 3); err != nil || string(got) != "xxxxx" {
+		t.Fatalf("跨文件读取错误：%q %v", got, err)
+	}
+	if after := fds(); after > before {
+		t.Errorf("读写之后多占用了%d个文件句柄", after-before)
+	}
+}
+
+func TestRejectEscapingPath(t *testing.T) {
+	m := testMeta()
+	m.Files = []*god.Entry{{Path: "../evil", Size: m.FileSize, Offset: 0}}
+	var buf bytes.Buffer
+	if err := god.Encode(&buf, m); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := god.Decode(&buf); !errors.Is(err, god.ErrBadFormat) {
+		t.Fatalf("期望路径错误，得到：%v", err)
+	}
+}
+
+func TestValidName(t *testing.T) {
+	for name, want := range map[string]bool{
+		"a.zip":     true,
+		"my files":  true,
+		"":          false,
+		".":         false,
+		"..":        false,
+		"../a":      false,
+		"a/b":       false,
+		"/etc":      false,
+		"a\\b":      false,
+		"..\\a.zip": false,
+	} {
+		if got := god.ValidName(name); got != want {
+			t.Errorf("ValidName(%q)=%v，期望%v", name, got, want)
+		}
+	}
+}
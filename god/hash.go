@@ -0,0 +1,54 @@
+package god
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"hash/crc32"
+)
+
+// HashAlgo 分片哈希算法编号，写在元数据头部
+type HashAlgo uint8
+
+const (
+	HashCRC32  HashAlgo = 1 //crc32（IEEE），旧版元数据使用。只能发现意外损坏，无法防止伪造
+	HashSHA256 HashAlgo = 2 //sha256
+)
+
+// Valid 是否是已知的算法
+func (a HashAlgo) Valid() bool {
+	switch a {
+	case HashCRC32, HashSHA256:
+		return true
+	}
+	return false
+}
+
+// Size 哈希值的字节数
+func (a HashAlgo) Size() int {
+	switch a {
+	case HashCRC32:
+		return crc32.Size
+	case HashSHA256:
+		return sha256.Size
+	}
+	return 0
+}
+
+// Sum 计算data的哈希值，返回十六进制字符串。未知算法返回空串。
+func (a HashAlgo) Sum(data []byte) string {
+	switch a {
+	case HashCRC32:
+		return crc32Hex(crc32.ChecksumIEEE(data))
+	case HashSHA256:
+		sum := sha256.Sum256(data)
+		return hex.EncodeToString(sum[:])
+	}
+	return ""
+}
+
+func crc32Hex(sum uint32) string {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], sum)
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,61 @@
+package god
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+)
+
+//旧版.god文件是直接gob编码的结构体，没有头部。这里保留原来的结构，用于迁移。
+
+const legacyPieceSize = 1024 * 1024 //旧版固定的分片大小
+
+type legacyFileInfo struct {
+	FileName      string
+	FilePiecesNum int
+	FileSize      int
+	FilePieces    []*legacyPiece
+}
+
+type legacyPiece struct {
+	PieceIndex int
+	PieceStart int
+	PieceSize  int
+	PieceHash  uint32
+}
+
+// 解析旧版gob文件，迁移为Meta
+func decodeGob(r io.Reader) (*Meta, error) {
+	var old legacyFileInfo
+	if err := gob.NewDecoder(r).Decode(&old); err != nil {
+		return nil, fmt.Errorf("%w: 既不是当前格式，也不是旧版gob格式: %v", ErrBadFormat, err)
+	}
+
+	m := Meta{
+		Version:       1, //没有默克尔根，按版本1的规则校验
+		HashAlgo:      HashCRC32,
+		PieceSize:     legacyPieceSize,
+		FileName:      old.FileName,
+		FileSize:      old.FileSize,
+		FilePiecesNum: old.FilePiecesNum,
+		FilePieces:    make([]*Piece, 0, len(old.FilePieces)),
+	}
+	if len(old.FilePieces) > 1 {
+		m.PieceSize = old.FilePieces[0].PieceSize
+	}
+	for _, p := range old.FilePieces {
+		if p == nil {
+			return nil, fmt.Errorf("%w: 旧版分片信息为空", ErrBadFormat)
+		}
+		m.FilePieces = append(m.FilePieces, &Piece{
+			PieceIndex: p.PieceIndex,
+			PieceStart: p.PieceStart,
+			PieceSize:  p.PieceSize,
+			PieceHash:  crc32Hex(p.PieceHash),
+		})
+	}
+	if err := m.validate(); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
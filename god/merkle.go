@@ -0,0 +1,70 @@
+package god
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+)
+
+//默克尔树。叶子为sha256(0x00 || 分片哈希值)，内部节点为sha256(0x01 || 左 || 右)，
+//某一层节点数为奇数时，最后一个节点直接提升到上一层。没有分片的空文件，根为sha256("")。
+//叶子和内部节点加上不同的前缀，内部节点就不能被当成叶子，防止伪造。
+//版本2、3的叶子直接使用分片哈希值，没有前缀，读取旧文件时按旧规则计算。
+
+// MerkleRoot 由各分片的哈希值（十六进制）按当前版本计算默克尔根（十六进制）
+func MerkleRoot(pieceHashes []string) (string, error) {
+	return merkleRoot(pieceHashes, true)
+}
+
+// leafPrefix为false时按版本2、3的规则计算
+func merkleRoot(pieceHashes []string, leafPrefix bool) (string, error) {
+	if len(pieceHashes) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:]), nil
+	}
+	level := make([][]byte, len(pieceHashes))
+	for i, h := range pieceHashes {
+		b, err := hex.DecodeString(h)
+		if err != nil {
+			return "", fmt.Errorf("%w: 第%d片哈希值不是十六进制", ErrBadFormat, i)
+		}
+		if leafPrefix {
+			h := sha256.New()
+			h.Write([]byte{0x00})
+			h.Write(b)
+			b = h.Sum(nil)
+		}
+		level[i] = b
+	}
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i])
+				break
+			}
+			h := sha256.New()
+			h.Write([]byte{0x01})
+			h.Write(level[i])
+			h.Write(level[i+1])
+			next = append(next, h.Sum(nil))
+		}
+		level = next
+	}
+	return hex.EncodeToString(level[0]), nil
+}
+
+// Root 由分片表计算默克尔根，规则取决于元数据的版本，没有版本时按当前版本
+func (m *Meta) Root() (string, error) {
+	hashes := make([]string, len(m.FilePieces))
+	for i, p := range m.FilePieces {
+		hashes[i] = p.PieceHash
+	}
+	return merkleRoot(hashes, m.Version == 0 || m.Version >= 4)
+}
+
+// ID 文件的身份标识，即默克尔根。内容相同的文件ID相同，内容一变ID就变。
+// 旧版元数据没有默克尔根，返回空串。
+func (m *Meta) ID() string {
+	return m.MerkleRoot
+}
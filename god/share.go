@@ -0,0 +1,179 @@
+package god
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+//分享的读写。单个文件和目录分享统一看作若干个首尾相接的文件，按在整个分享中的偏移量读写。
+//目录中的空文件夹不会被记录。
+
+// IsDir 是否是目录分享
+func (m *Meta) IsDir() bool {
+	return len(m.Files) != 0
+}
+
+// Entries 分享包含的文件。单个文件时返回一项，路径为空，表示分享本身
+func (m *Meta) Entries() []*Entry {
+	if m.IsDir() {
+		return m.Files
+	}
+	return []*Entry{{Path: "", Size: m.FileSize, Offset: 0}}
+}
+
+// 检查目录分享的文件表：路径必须是分享目录内的相对路径，各文件首尾相接
+func (m *Meta) validateFiles() error {
+	next := 0
+	seen := make(map[string]struct{}, len(m.Files))
+	for i, e := range m.Files {
+		if e == nil || !validPath(e.Path) || e.Size < 0 || e.Offset != next {
+			return fmt.Errorf("%w: 第%d个文件信息错误", ErrBadFormat, i)
+		}
+		if _, ok := seen[e.Path]; ok {
+			return fmt.Errorf("%w: 文件%s重复", ErrBadFormat, e.Path)
+		}
+		seen[e.Path] = struct{}{}
+		next += e.Size
+	}
+	if m.IsDir() && next != m.FileSize {
+		return fmt.Errorf("%w: 文件总大小与分享大小不一致", ErrBadFormat)
+	}
+	return nil
+}
+
+// 路径不能跳出分享目录，客户端会按这个路径创建文件
+func validPath(p string) bool {
+	if p == "" || path.IsAbs(p) || strings.Contains(p, "\\") || path.Clean(p) != p {
+		return false
+	}
+	return p != "." && p != ".." && !strings.HasPrefix(p, "../")
+}
+
+// ValidName 分享名必须是单独的一级名字，不能带目录，客户端会在下载目录下按这个名字创建文件
+func ValidName(name string) bool {
+	return validPath(name) && !strings.Contains(name, "/")
+}
+
+// Share 分享，可以按整个分享的偏移量读写。
+// 文件在读写时才打开、用完就关，目录里有成千上万个文件时也不会一下子占用那么多文件句柄
+type Share struct {
+	root    string
+	entries []*Entry
+	flag    int //读写时打开文件的方式
+}
+
+// Open 以只读方式打开分享。root为分享的路径：单个文件时是文件本身，目录分享时是目录
+func Open(root string, m *Meta) (*Share, error) {
+	if _, err := os.Stat(root); err != nil {
+		return nil, err
+	}
+	return &Share{root: root, entries: m.Entries(), flag: os.O_RDONLY}, nil
+}
+
+// Create 按元数据创建分享，目录分享会建好整个目录树。已存在的文件会被截断
+func Create(root string, m *Meta) (*Share, error) {
+	s := &Share{root: root, entries: m.Entries(), flag: os.O_RDWR}
+	if m.IsDir() {
+		if err := os.MkdirAll(root, 0755); err != nil {
+			return nil, err
+		}
+	}
+	for _, e := range s.entries { //逐个创建，同一时间只打开一个文件
+		name := s.path(e)
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+		if err != nil {
+			return nil, err
+		}
+		if err = f.Close(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func (s *Share) path(e *Entry) string {
+	if e.Path == "" {
+		return s.root
+	}
+	return filepath.Join(s.root, filepath.FromSlash(e.Path))
+}
+
+// 对整个分享中从off开始的len(p)个字节，逐个文件打开后调用op
+func (s *Share) each(p []byte, off int64, op func(f *os.File, b []byte, off int64) (int, error)) (int, error) {
+	n := 0
+	for _, seg := range Segments(s.entries, off, int64(len(p))) {
+		f, err := os.OpenFile(s.path(s.entries[seg.Index]), s.flag, 0644)
+		if err != nil {
+			return n, err
+		}
+		m, err := op(f, p[n:n+int(seg.Length)], seg.Offset)
+		closeErr := f.Close()
+		n += m
+		if err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// ReadAt 从整个分享的off处读取，可以跨越文件边界
+func (s *Share) ReadAt(p []byte, off int64) (int, error) {
+	n, err := s.each(p, off, (*os.File).ReadAt)
+	if err == nil && n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// WriteAt 向整个分享的off处写入，可以跨越文件边界
+func (s *Share) WriteAt(p []byte, off int64) (int, error) {
+	n, err := s.each(p, off, (*os.File).WriteAt)
+	if err == nil && n < len(p) {
+		err = io.ErrShortWrite
+	}
+	return n, err
+}
+
+// Close 文件都是用完就关的，没有需要释放的资源，留着让调用方可以统一defer Close
+func (s *Share) Close() error {
+	return nil
+}
+
+// Segment 一段连续的字节在某个文件中的位置
+type Segment struct {
+	Index  int   //文件在Entries中的下标
+	Offset int64 //在文件内的偏移量
+	Length int64 //长度
+}
+
+// Segments 将整个分享中从off开始的n个字节，拆分成各个文件中的片段。超出分享末尾的部分会被忽略
+func Segments(entries []*Entry, off, n int64) []Segment {
+	var segs []Segment
+	for i, e := range entries {
+		if n <= 0 {
+			break
+		}
+		start, end := int64(e.Offset), int64(e.Offset+e.Size)
+		if off >= end || e.Size == 0 {
+			continue
+		}
+		length := end - off
+		if length > n {
+			length = n
+		}
+		segs = append(segs, Segment{Index: i, Offset: off - start, Length: length})
+		off += length
+		n -= length
+	}
+	return segs
+}
@@ -0,0 +1,45 @@
+package protocol
+
+import "math/bits"
+
+// Bitfield 客户端拥有哪些分片，第i位表示第i个分片，高位在前。JSON中编码为base64
+type Bitfield []byte
+
+// NewBitfield 创建n个分片的空位图
+func NewBitfield(n int) Bitfield {
+	return make(Bitfield, (n+7)/8)
+}
+
+// FullBitfield 创建n个分片全部拥有的位图
+func FullBitfield(n int) Bitfield {
+	b := NewBitfield(n)
+	for i := 0; i < n; i++ {
+		b.Set(i)
+	}
+	return b
+}
+
+// Has 是否拥有第i个分片，越界时返回false
+func (b Bitfield) Has(i int) bool {
+	if i < 0 || i/8 >= len(b) {
+		return false
+	}
+	return b[i/8]&(0x80>>(i%8)) != 0
+}
+
+// Set 标记拥有第i个分片，越界时忽略
+func (b Bitfield) Set(i int) {
+	if i < 0 || i/8 >= len(b) {
+		return
+	}
+	b[i/8] |= 0x80 >> (i % 8)
+}
+
+// Count 拥有的分片数
+func (b Bitfield) Count() int {
+	n := 0
+	for _, v := range b {
+		n += bits.OnesCount8(v)
+	}
+	return n
+}
@@ -0,0 +1,12 @@
+package protocol
+
+import "encoding/hex"
+
+// ValidPeerID 客户端标识为40位十六进制，客户端随机生成，服务端和其它客户端据此识别它
+func ValidPeerID(id string) bool {
+	if len(id) != 40 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
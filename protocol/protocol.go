@@ -0,0 +1,143 @@
+// Package protocol 定义追踪器（服务端）和客户端之间websocket上的控制消息。
+//
+// 每条消息是一个JSON文本帧，type表示消息类型，data是对应类型的内容：
+//
+//	{"type":"hello","data":{"version":1,"files":["a.zip"]}}
+//
+// 客户端建立连接后先发送hello，服务端回复welcome，之后双方按需发送其它消息。
+// 无法识别的消息回复error，不断开连接，方便以后增加新的消息类型。
+//
+//	类型      方向           含义
+//	hello     客户端→服务端  协议版本和已下载的文件列表
+//	welcome   服务端→客户端  协议版本、服务端看到的客户端IP和验证访问凭证用的公钥
+//	ping      服务端→客户端  心跳
+//	pong      客户端→服务端  心跳回复
+//	have      客户端→服务端  新下载好了某个文件的若干分片，可以向其它客户端提供
+//	complete  客户端→服务端  某个文件下载完成
+//	remove    双向           服务端：文件已从服务器删除；客户端：本地不再提供这个文件
+//	changed   服务端→客户端  文件已在服务器更新，本地的旧文件作废
+//	peers     服务端→客户端  文件swarm中客户端的加入、分片更新和离开，只发给还没下载完的客户端
+//	error     双向           对方发来的消息有误
+//	notice    服务端→客户端  给用户看的提示
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Version 当前的协议版本
+//
+//	1  初始版本
+//	2  have携带新增分片的编号
+//	3  peers携带客户端的分片位图
+//	4  welcome携带追踪器签发访问凭证用的公钥，客户端之间请求分片需要凭证
+//	5  访问凭证绑定追踪器看到的持有者IP，不再绑定客户端标识
+const Version = 5
+
+// Type 消息类型
+type Type string
+
+const (
+	TypeHello    Type = "hello"
+	TypeWelcome  Type = "welcome"
+	TypePing     Type = "ping"
+	TypePong     Type = "pong"
+	TypeHave     Type = "have"
+	TypeComplete Type = "complete"
+	TypeRemove   Type = "remove"
+	TypeChanged  Type = "changed"
+	TypePeers    Type = "peers"
+	TypeError    Type = "error"
+	TypeNotice   Type = "notice"
+)
+
+// Message 一条控制消息
+type Message struct {
+	Type Type            `json:"type"`
+	Data json.RawMessage `json:"data,omitempty"`
+}
+
+// Hello 客户端的第一条消息
+type Hello struct {
+	Version int      `json:"version"` //客户端的协议版本
+	Files   []string `json:"files"`   //已下载完成的文件
+}
+
+// Welcome 服务端对hello的回复
+type Welcome struct {
+	Version   int    `json:"version"`    //服务端的协议版本
+	IP        string `json:"ip"`         //服务端看到的客户端IP，即客户端的公网IP
+	TicketKey []byte `json:"ticket_key"` //追踪器的Ed25519公钥，用来验证其它客户端带来的访问凭证
+}
+
+// File 只涉及一个文件的消息，用于complete、remove、changed
+type File struct {
+	FileName string `json:"file_name"`
+}
+
+// Have 新下载好的分片
+type Have struct {
+	FileName string `json:"file_name"`
+	Pieces   []int  `json:"pieces"` //分片编号
+}
+
+// Peer 文件swarm中的一个客户端
+type Peer struct {
+	Addr     string   `json:"addr"`     //客户端地址
+	Bitfield Bitfield `json:"bitfield"` //拥有的分片
+}
+
+// Peers 文件swarm中客户端的变化
+type Peers struct {
+	FileName string   `json:"file_name"`
+	Added    []Peer   `json:"added,omitempty"`   //新加入或者分片有更新的客户端，地址相同时替换原来的记录
+	Removed  []string `json:"removed,omitempty"` //离开的客户端地址
+}
+
+// Error 错误消息
+type Error struct {
+	Type    Type   `json:"type,omitempty"` //出错的消息类型
+	Message string `json:"message"`
+}
+
+// Notice 提示消息
+type Notice struct {
+	Message string `json:"message"`
+}
+
+// New 构造消息，data为nil时没有内容
+func New(t Type, data any) ([]byte, error) {
+	msg := Message{Type: t}
+	if data != nil {
+		raw, err := json.Marshal(data)
+		if err != nil {
+			return nil, err
+		}
+		msg.Data = raw
+	}
+	return json.Marshal(msg)
+}
+
+// Parse 解析消息
+func Parse(buf []byte) (Message, error) {
+	var msg Message
+	if err := json.Unmarshal(buf, &msg); err != nil {
+		return Message{}, err
+	}
+	if msg.Type == "" {
+		return Message{}, fmt.Errorf("消息缺少type")
+	}
+	return msg, nil
+}
+
+// Decode 解析消息内容
+func (m Message) Decode(v any) error {
+	if len(m.Data) == 0 {
+		return fmt.Errorf("%s消息缺少data", m.Type)
+	}
+	if err := json.Unmarshal(m.Data, v); err != nil {
+		return fmt.Errorf("%s消息格式错误：%w", m.Type, err)
+	}
+	return nil
+}
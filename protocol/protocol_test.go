@@ -0,0 +1,89 @@
+package protocol_test
+
+import (
+	"Gdown/protocol"
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBitfield(t *testing.T) {
+	b := protocol.NewBitfield(10)
+	if len(b) != 2 {
+		t.Fatalf("10个分片应该占2字节，实际%d", len(b))
+	}
+	b.Set(0)
+	b.Set(9)
+	b.Set(16) //越界
+	if !b.Has(0) || !b.Has(9) || b.Has(1) || b.Has(16) || b.Has(-1) {
+		t.Fatalf("位图内容错误：%08b", b)
+	}
+	if b.Count() != 2 {
+		t.Fatalf("分片数应该为2，实际%d", b.Count())
+	}
+	if protocol.FullBitfield(10).Count() != 10 {
+		t.Fatal("FullBitfield分片数错误")
+	}
+}
+
+func TestHaveRoundTrip(t *testing.T) {
+	buf, err := protocol.New(protocol.TypeHave, protocol.Have{FileName: "a.zip", Pieces: []int{1, 3}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := protocol.Parse(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var have protocol.Have
+	if err = msg.Decode(&have); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Type != protocol.TypeHave || have.FileName != "a.zip" || len(have.Pieces) != 2 || have.Pieces[1] != 3 {
+		t.Fatalf("解析结果错误：%+v %+v", msg, have)
+	}
+}
+
+func TestTicket(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ticket := protocol.Ticket{User: "alice", Host: "10.0.0.1", FileName: "a.zip", Expires: now.Add(time.Minute).Unix()}
+	s, err := protocol.SignTicket(ticket, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := protocol.VerifyTicket(s, pub, now)
+	if err != nil || got != ticket {
+		t.Fatalf("验证凭证失败：%v %+v", err, got)
+	}
+	if _, err = protocol.VerifyTicket(s, pub, now.Add(2*time.Minute)); err != protocol.ErrTicketExpired {
+		t.Fatalf("过期的凭证应该返回ErrTicketExpired，实际%v", err)
+	}
+	otherPub, _, _ := ed25519.GenerateKey(nil)
+	if _, err = protocol.VerifyTicket(s, otherPub, now); err != protocol.ErrTicketInvalid {
+		t.Fatalf("其它公钥不应该验证通过，实际%v", err)
+	}
+	forged := strings.Replace(s, s[:4], "eyJ2", 1)
+	if _, err = protocol.VerifyTicket(forged, pub, now); err != protocol.ErrTicketInvalid {
+		t.Fatalf("篡改过的凭证不应该验证通过，实际%v", err)
+	}
+}
+
+func TestValidPeerID(t *testing.T) {
+	for id, want := range map[string]bool{
+		"0123456789abcdef0123456789abcdef01234567":  true,
+		"0123456789ABCDEF0123456789ABCDEF01234567":  true,
+		"0123456789abcdef0123456789abcdef0123456":   false,
+		"0123456789abcdef0123456789abcdef012345678": false,
+		"0123456789abcdef0123456789abcdef0123456g":  false,
+		"": false,
+	} {
+		if got := protocol.ValidPeerID(id); got != want {
+			t.Errorf("ValidPeerID(%q)=%v，期望%v", id, got, want)
+		}
+	}
+}
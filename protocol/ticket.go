@@ -0,0 +1,68 @@
+package protocol
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+//访问凭证。客户端之间请求分片时，下载者在X-Gdown-Ticket请求头中带上追踪器签发的凭证，
+//提供分片的客户端用welcome中拿到的追踪器公钥验证，不需要再问服务器。
+//
+//凭证的格式为 base64url(JSON) + "." + base64url(Ed25519签名)，签名覆盖前半部分。
+
+// TicketHeader 携带访问凭证的请求头
+const TicketHeader = "X-Gdown-Ticket"
+
+var (
+	ErrTicketInvalid = errors.New("访问凭证无效")
+	ErrTicketExpired = errors.New("访问凭证已过期")
+)
+
+// Ticket 追踪器签发给某个用户的客户端、用于下载某个文件的凭证
+type Ticket struct {
+	User     string `json:"user"`
+	Host     string `json:"host"` //追踪器看到的持有者IP。请求头里的客户端标识谁都能填，IP是提供分片的客户端自己能看到的
+	FileName string `json:"file_name"`
+	Expires  int64  `json:"exp"` //过期时间，Unix秒
+}
+
+// ExpiresAt 过期时间
+func (t Ticket) ExpiresAt() time.Time {
+	return time.Unix(t.Expires, 0)
+}
+
+// SignTicket 用追踪器的私钥签发凭证
+func SignTicket(t Ticket, key ed25519.PrivateKey) (string, error) {
+	buf, err := json.Marshal(t)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(buf)
+	sig := ed25519.Sign(key, []byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyTicket 用追踪器的公钥校验凭证的签名和有效期
+func VerifyTicket(s string, key ed25519.PublicKey, now time.Time) (Ticket, error) {
+	var t Ticket
+	payload, sig, ok := strings.Cut(s, ".")
+	if !ok || len(key) != ed25519.PublicKeySize {
+		return t, ErrTicketInvalid
+	}
+	rawSig, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !ed25519.Verify(key, []byte(payload), rawSig) {
+		return t, ErrTicketInvalid
+	}
+	buf, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil || json.Unmarshal(buf, &t) != nil {
+		return Ticket{}, ErrTicketInvalid
+	}
+	if now.After(t.ExpiresAt()) {
+		return t, ErrTicketExpired
+	}
+	return t, nil
+}
@@ -2,12 +2,16 @@ package main
 
 import (
 	"Gdown/server/src"
+	"Gdown/server/src/config"
 	"Gdown/server/src/user"
 )
 
 // 启动服务
 func main() {
+	config.ReadConfig()
 	user.InitDB()
+	src.InitTracker()
 	src.LoadFile()
+	go src.WatchFile()
 	src.InitRouter()
 }
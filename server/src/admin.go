@@ -0,0 +1,234 @@
+package src
+
+//管理接口。只有配置文件admins中列出的用户可以使用，token放在Authorization请求头中。
+//可以查看在线客户端、断开客户端、封禁用户或IP、把客户端移出文件的swarm。
+
+import (
+	"Gdown/server/src/config"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 校验管理员身份，通过后把用户名存入上下文的admin。需要放在auth之后
+func adminAuth(c *gin.Context) {
+	claims := requestUser(c)
+	for _, admin := range config.Cfg.Admins {
+		if admin == claims.Username {
+			c.Set("admin", claims.Username)
+			c.Next()
+			return
+		}
+	}
+	c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+		"message": "需要管理员权限",
+	})
+}
+
+// 客户端在某个文件swarm中的情况
+type seededFile struct {
+	FileName string `json:"file_name"`
+	Pieces   int    `json:"pieces"`    //拥有的分片数
+	PieceNum int    `json:"piece_num"` //文件的分片总数
+}
+
+// 在线客户端
+type peerStatus struct {
+	PeerID      string       `json:"peer_id"`
+	User        string       `json:"user"`
+	Addr        string       `json:"addr"`
+	ConnectedAt time.Time    `json:"connected_at"`
+	Files       []seededFile `json:"files"`
+}
+
+// 列出在线客户端，按连接时间排序
+func adminPeers(c *gin.Context) {
+	clients := tracker.Online()
+	peers := make([]peerStatus, 0, len(clients))
+	for _, cli := range clients {
+		p, _, err := tracker.store.GetPeer(cli.ID)
+		var files []string
+		if err == nil {
+			files, err = tracker.store.PeerFiles(cli.ID)
+		}
+		if err != nil {
+			log.Println("获取客户端", cli.ID, "的信息失败：", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "服务器内部错误",
+			})
+			return
+		}
+		status := peerStatus{
+			PeerID:      cli.ID,
+			User:        cli.User,
+			Addr:        cli.IPAdr,
+			ConnectedAt: p.ConnectedAt,
+			Files:       make([]seededFile, 0, len(files)),
+		}
+		for _, fileName := range files {
+			f := seededFile{FileName: fileName}
+			if bf, ok, err := tracker.store.Pieces(fileName, cli.ID); err == nil && ok {
+				f.Pieces = bf.Count()
+			}
+			if info, ok := tracker.File(fileName); ok {
+				f.PieceNum = info.FilePiecesNum
+			}
+			status.Files = append(status.Files, f)
+		}
+		sort.Slice(status.Files, func(i, j int) bool { return status.Files[i].FileName < status.Files[j].FileName })
+		peers = append(peers, status)
+	}
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ConnectedAt.Before(peers[j].ConnectedAt) })
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"peers":   peers,
+	})
+}
+
+// 断开客户端的websocket连接
+func adminKick(c *gin.Context) {
+	id := c.Param("id")
+	if !tracker.Kick(id, "已被管理员断开连接") {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "客户端不在线",
+		})
+		return
+	}
+	log.Println("管理员", c.GetString("admin"), "断开了客户端", id)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "已断开",
+	})
+}
+
+// 封禁列表
+func adminBans(c *gin.Context) {
+	bans := tracker.Bans()
+	sort.Slice(bans, func(i, j int) bool { return bans[i].CreatedAt.Before(bans[j].CreatedAt) })
+	c.JSON(http.StatusOK, gin.H{
+		"message": "ok",
+		"bans":    bans,
+	})
+}
+
+// 封禁用户或IP，同时断开被封禁的在线客户端
+func adminBan(c *gin.Context) {
+	var request struct {
+		Kind   string `json:"kind"`
+		Value  string `json:"value"`
+		Reason string `json:"reason"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "请求格式错误",
+		})
+		return
+	}
+	if !validBan(request.Kind, request.Value) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "kind只能是user或addr，addr必须是IP",
+		})
+		return
+	}
+	b := Ban{
+		Kind:      request.Kind,
+		Value:     request.Value,
+		Reason:    request.Reason,
+		By:        c.GetString("admin"),
+		CreatedAt: time.Now(),
+	}
+	kicked, err := tracker.Ban(b)
+	if err != nil {
+		log.Println("添加封禁失败：", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "服务器内部错误",
+		})
+		return
+	}
+	log.Println("管理员", b.By, "封禁了", b.Kind, b.Value, "，原因：", b.Reason)
+	c.JSON(http.StatusOK, gin.H{
+		"message": "已封禁",
+		"kicked":  kicked, //断开的在线客户端数目
+	})
+}
+
+// 解除封禁
+func adminUnban(c *gin.Context) {
+	kind, value := c.Param("kind"), c.Param("value")
+	if !validBan(kind, value) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "kind只能是user或addr，addr必须是IP",
+		})
+		return
+	}
+	ok, err := tracker.Unban(kind, value)
+	if err != nil {
+		log.Println("解除封禁失败：", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "服务器内部错误",
+		})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "封禁不存在",
+		})
+		return
+	}
+	log.Println("管理员", c.GetString("admin"), "解除了", kind, value, "的封禁")
+	c.JSON(http.StatusOK, gin.H{
+		"message": "已解除封禁",
+	})
+}
+
+func validBan(kind, value string) bool {
+	switch kind {
+	case BanUser:
+		return value != ""
+	case BanAddr:
+		return net.ParseIP(value) != nil
+	}
+	return false
+}
+
+// 清空文件的swarm，或者只把一个客户端移出swarm。被移出的在线客户端会收到提示，
+// 单个移出的客户端在文件更新或服务器重启之前不能再加入这个文件的swarm
+func adminRemoveSwarm(c *gin.Context) {
+	fileName, id := c.Param("file"), c.Param("id")
+	if id == "" {
+		clients := tracker.ResetSwarm(fileName)
+		for _, cli := range clients {
+			cli.sendNotice("管理员清空了" + fileName + "的客户端列表")
+		}
+		log.Println("管理员", c.GetString("admin"), "清空了", fileName, "的swarm")
+		c.JSON(http.StatusOK, gin.H{
+			"message": "已清空",
+		})
+		return
+	}
+
+	ok, err := tracker.Exclude(fileName, id)
+	if err != nil {
+		log.Println("把客户端", id, "移出", fileName, "的swarm失败：", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "服务器内部错误",
+		})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "客户端不在这个文件的客户端列表中",
+		})
+		return
+	}
+	if cli, ok := tracker.Client(id); ok {
+		cli.sendNotice("管理员把你移出了" + fileName + "的客户端列表")
+	}
+	log.Println("管理员", c.GetString("admin"), "把客户端", id, "移出了", fileName, "的swarm")
+	c.JSON(http.StatusOK, gin.H{
+		"message": "已移出",
+	})
+}
@@ -0,0 +1,135 @@
+package src
+
+import (
+	"Gdown/god"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 只挂管理接口的路由，跳过登录和管理员校验
+func adminRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	a := r.Group("/admin", func(c *gin.Context) { c.Set("admin", "root") })
+	a.DELETE("/peers/:id", adminKick)
+	a.GET("/bans", adminBans)
+	a.POST("/bans", adminBan)
+	a.DELETE("/bans/:kind/:value", adminUnban)
+	a.DELETE("/swarms/:file", adminRemoveSwarm)
+	a.DELETE("/swarms/:file/:id", adminRemoveSwarm)
+	return r
+}
+
+func doRequest(r http.Handler, method, path, body string) int {
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+	return w.Code
+}
+
+func TestMatchBan(t *testing.T) {
+	tests := []struct {
+		ban        Ban
+		user, host string
+		want       bool
+	}{
+		{Ban{Kind: BanUser, Value: "bob"}, "bob", "10.0.0.1", true},
+		{Ban{Kind: BanUser, Value: "bob"}, "alice", "10.0.0.1", false},
+		{Ban{Kind: BanUser, Value: "10.0.0.1"}, "alice", "10.0.0.1", false}, //用户封禁不匹配IP
+		{Ban{Kind: BanAddr, Value: "10.0.0.1"}, "alice", "10.0.0.1", true},
+		{Ban{Kind: BanAddr, Value: "10.0.0.1"}, "alice", "10.0.0.2", false},
+		{Ban{Kind: BanAddr, Value: "bob"}, "bob", "10.0.0.2", false}, //IP封禁不匹配用户名
+	}
+	for _, tt := range tests {
+		if got := matchBan(tt.ban, tt.user, tt.host); got != tt.want {
+			t.Errorf("matchBan(%+v, %q, %q)=%v，期望%v", tt.ban, tt.user, tt.host, got, tt.want)
+		}
+	}
+}
+
+func TestAdminBans(t *testing.T) {
+	setupShare(t)
+	r := adminRouter()
+	bob := &client{ID: "p1", User: "bob", IPAdr: "10.0.0.1:9000", out: make(chan []byte, sendQueueSize)}
+	if err := tracker.Connect(bob); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", "/admin/bans", `{"kind":"group","value":"bob"}`, http.StatusBadRequest},
+		{"POST", "/admin/bans", `{"kind":"addr","value":"not-an-ip"}`, http.StatusBadRequest},
+		{"POST", "/admin/bans", `{"kind":"user","value":""}`, http.StatusBadRequest},
+		{"POST", "/admin/bans", `not json`, http.StatusBadRequest},
+		{"POST", "/admin/bans", `{"kind":"user","value":"bob","reason":"spam"}`, http.StatusOK},
+		{"GET", "/admin/bans", "", http.StatusOK},
+		{"DELETE", "/admin/bans/addr/not-an-ip", "", http.StatusBadRequest},
+		{"DELETE", "/admin/bans/user/bob", "", http.StatusOK},
+		{"DELETE", "/admin/bans/user/bob", "", http.StatusNotFound},
+		{"DELETE", "/admin/peers/nobody", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		if code := doRequest(r, tt.method, tt.path, tt.body); code != tt.want {
+			t.Fatalf("%s %s %s：状态码%d，期望%d", tt.method, tt.path, tt.body, code, tt.want)
+		}
+	}
+	//封禁时在线的bob先收到原因，然后连接被关闭
+	if len(bob.out) != 2 || !strings.Contains(string(<-bob.out), "spam") || <-bob.out != nil {
+		t.Fatal("被封禁的客户端没有收到原因或者没有被断开")
+	}
+}
+
+func TestAdminRemoveSwarm(t *testing.T) {
+	setupShare(t)
+	r := adminRouter()
+	info := &FileInfo{Meta: god.Meta{FileName: "a.zip", FilePiecesNum: 4}}
+	tracker.PutFile(info)
+	for _, id := range []string{"p1", "p2"} {
+		if err := tracker.Complete("a.zip", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if code := doRequest(r, "DELETE", "/admin/swarms/a.zip/p1", ""); code != http.StatusOK {
+		t.Fatalf("移出客户端：状态码%d", code)
+	}
+	if code := doRequest(r, "DELETE", "/admin/swarms/a.zip/p1", ""); code != http.StatusNotFound {
+		t.Fatalf("移出不在swarm中的客户端：状态码%d，期望404", code)
+	}
+	if code := doRequest(r, "DELETE", "/admin/swarms/a.zip/nobody", ""); code != http.StatusNotFound {
+		t.Fatalf("移出不存在的客户端：状态码%d，期望404", code)
+	}
+
+	//被移出的客户端不能通过have、complete或/meta重新加入
+	for name, rejoin := range map[string]func() error{
+		"have":     func() error { return tracker.Have("a.zip", "p1", []int{0}) },
+		"complete": func() error { return tracker.Complete("a.zip", "p1") },
+		"join":     func() error { return tracker.Join("a.zip", "p1") },
+	} {
+		if err := rejoin(); !errors.Is(err, ErrExcluded) {
+			t.Fatalf("%s：期望ErrExcluded，实际%v", name, err)
+		}
+	}
+	if n := tracker.SeederCount("a.zip"); n != 1 {
+		t.Fatalf("swarm中有%d个客户端，期望1个", n)
+	}
+
+	//文件更新之后可以重新加入
+	tracker.PutFile(&FileInfo{Meta: god.Meta{FileName: "a.zip", FilePiecesNum: 4}})
+	if err := tracker.Complete("a.zip", "p1"); err != nil {
+		t.Fatal("文件更新之后仍然不能加入：", err)
+	}
+
+	if code := doRequest(r, "DELETE", "/admin/swarms/a.zip", ""); code != http.StatusOK {
+		t.Fatalf("清空swarm：状态码%d", code)
+	}
+	if n := tracker.SeederCount("a.zip"); n != 0 {
+		t.Fatalf("清空之后还有%d个客户端", n)
+	}
+}
@@ -0,0 +1,67 @@
+package src
+
+//鉴权中间件。需要登录的接口都先经过auth：校验Authorization中的access token，检查用户和IP是否被封禁，
+//通过后把身份信息存入上下文。/meta、/down等数据接口再经过peerAuth，要求X-Peer-ID是这个用户已经建立连接的客户端。
+//没有token或者token无效时返回401，身份有效但是没有权限时返回403。
+
+import (
+	"Gdown/server/src/user"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ctxClaims = "claims" //上下文中的token身份信息
+	ctxPeer   = "peer"   //上下文中发起请求的客户端
+)
+
+// 校验access token和封禁状态
+func auth(c *gin.Context) {
+	claims, err := user.ParseToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+			"message": "未授权",
+		})
+		return
+	}
+	//被封禁的用户和IP不能使用
+	if ban, banned := tracker.Banned(claims.Username, c.ClientIP()); banned {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"message": "已被封禁：" + ban.Reason,
+		})
+		return
+	}
+	c.Set(ctxClaims, claims)
+	c.Next()
+}
+
+// 根据X-Peer-ID找到发起请求的在线客户端。客户端必须属于token中的用户，请求必须来自客户端建立连接时的IP，
+// 防止冒用别人的标识。需要放在auth之后
+func peerAuth(c *gin.Context) {
+	cli, ok := tracker.Client(c.GetHeader("X-Peer-ID"))
+	if !ok || cli.host() != c.ClientIP() {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"message": "客户端未建立连接",
+		})
+		return
+	}
+	if cli.User != requestUser(c).Username {
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{
+			"message": ErrPeerOwned.Error(),
+		})
+		return
+	}
+	c.Set(ctxPeer, cli)
+	c.Next()
+}
+
+// 请求的用户，由auth存入
+func requestUser(c *gin.Context) *user.Claims {
+	return c.MustGet(ctxClaims).(*user.Claims)
+}
+
+// 发起请求的客户端，由peerAuth存入
+func requestPeer(c *gin.Context) *client {
+	return c.MustGet(ctxPeer).(*client)
+}
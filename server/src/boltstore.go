@@ -0,0 +1,313 @@
+package src
+
+//基于bbolt的持久化存储。服务器重启之后，追踪器仍然记得之前的客户端和swarm，
+//可以立即把它们交给下载者；长时间没有上线的客户端由追踪器按peer_ttl清理。
+//
+//桶的结构：
+//	peers           客户端标识 -> Peer的JSON
+//	swarms/<文件名>  客户端标识 -> 分片位图
+//	joined/<标识>    文件名 -> 空，客户端下线或被清理时用
+//	bans            类型:值 -> Ban的JSON
+
+import (
+	"Gdown/protocol"
+	"encoding/json"
+	"errors"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	bucketPeers  = []byte("peers")
+	bucketSwarms = []byte("swarms")
+	bucketJoined = []byte("joined")
+	bucketBans   = []byte("bans")
+)
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+// NewBoltStore 打开或创建bbolt数据库文件
+func NewBoltStore(path string) (Store, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second}) //文件被另一个服务器进程占用时不要一直等
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketPeers, bucketSwarms, bucketJoined, bucketBans} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) PutPeer(p Peer) error {
+	buf, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPeers).Put([]byte(p.ID), buf)
+	})
+}
+
+func (s *boltStore) GetPeer(id string) (Peer, bool, error) {
+	var p Peer
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		buf := tx.Bucket(bucketPeers).Get([]byte(id))
+		if buf == nil {
+			return nil
+		}
+		ok = true
+		return json.Unmarshal(buf, &p)
+	})
+	return p, ok, err
+}
+
+func (s *boltStore) DeletePeer(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := leaveAll(tx, id); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketPeers).Delete([]byte(id))
+	})
+}
+
+func (s *boltStore) LeaveAll(id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return leaveAll(tx, id)
+	})
+}
+
+func leaveAll(tx *bolt.Tx, id string) error {
+	joined := tx.Bucket(bucketJoined).Bucket([]byte(id))
+	if joined == nil {
+		return nil
+	}
+	var files []string
+	err := joined.ForEach(func(k, _ []byte) error {
+		files = append(files, string(k))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, fileName := range files {
+		if err = leave(tx, fileName, id); err != nil {
+			return err
+		}
+	}
+	return tx.Bucket(bucketJoined).DeleteBucket([]byte(id))
+}
+
+func (s *boltStore) Peers() ([]Peer, error) {
+	var peers []Peer
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPeers).ForEach(func(_, v []byte) error {
+			var p Peer
+			if err := json.Unmarshal(v, &p); err != nil {
+				return err
+			}
+			peers = append(peers, p)
+			return nil
+		})
+	})
+	return peers, err
+}
+
+func (s *boltStore) Join(fileName, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		swarm := tx.Bucket(bucketSwarms).Bucket([]byte(fileName))
+		if swarm != nil && swarm.Get([]byte(id)) != nil {
+			return nil
+		}
+		return join(tx, fileName, id, nil)
+	})
+}
+
+func (s *boltStore) SetPieces(fileName, id string, bf protocol.Bitfield) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return join(tx, fileName, id, bf)
+	})
+}
+
+func join(tx *bolt.Tx, fileName, id string, bf protocol.Bitfield) error {
+	swarm, err := tx.Bucket(bucketSwarms).CreateBucketIfNotExists([]byte(fileName))
+	if err != nil {
+		return err
+	}
+	if bf == nil {
+		bf = protocol.Bitfield{} //bbolt中nil值和不存在无法区分
+	}
+	if err = swarm.Put([]byte(id), bf); err != nil {
+		return err
+	}
+	joined, err := tx.Bucket(bucketJoined).CreateBucketIfNotExists([]byte(id))
+	if err != nil {
+		return err
+	}
+	return joined.Put([]byte(fileName), []byte{})
+}
+
+func (s *boltStore) Leave(fileName, id string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return leave(tx, fileName, id)
+	})
+}
+
+func leave(tx *bolt.Tx, fileName, id string) error {
+	if swarm := tx.Bucket(bucketSwarms).Bucket([]byte(fileName)); swarm != nil {
+		if err := swarm.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if k, _ := swarm.Cursor().First(); k == nil { //swarm空了
+			if err := tx.Bucket(bucketSwarms).DeleteBucket([]byte(fileName)); err != nil {
+				return err
+			}
+		}
+	}
+	if joined := tx.Bucket(bucketJoined).Bucket([]byte(id)); joined != nil {
+		return joined.Delete([]byte(fileName))
+	}
+	return nil
+}
+
+func (s *boltStore) Pieces(fileName, id string) (protocol.Bitfield, bool, error) {
+	var bf protocol.Bitfield
+	var ok bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		swarm := tx.Bucket(bucketSwarms).Bucket([]byte(fileName))
+		if swarm == nil {
+			return nil
+		}
+		v := swarm.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		ok = true
+		bf = append(protocol.Bitfield(nil), v...) //bbolt返回的切片只在事务内有效
+		return nil
+	})
+	return bf, ok, err
+}
+
+func (s *boltStore) SwarmPieces(fileName string) (map[string]protocol.Bitfield, error) {
+	pieces := make(map[string]protocol.Bitfield)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		swarm := tx.Bucket(bucketSwarms).Bucket([]byte(fileName))
+		if swarm == nil {
+			return nil
+		}
+		return swarm.ForEach(func(k, v []byte) error {
+			pieces[string(k)] = append(protocol.Bitfield(nil), v...)
+			return nil
+		})
+	})
+	return pieces, err
+}
+
+func (s *boltStore) Members(fileName string) ([]string, error) {
+	pieces, err := s.SwarmPieces(fileName)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(pieces))
+	for id := range pieces {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *boltStore) PeerFiles(id string) ([]string, error) {
+	var files []string
+	err := s.db.View(func(tx *bolt.Tx) error {
+		joined := tx.Bucket(bucketJoined).Bucket([]byte(id))
+		if joined == nil {
+			return nil
+		}
+		return joined.ForEach(func(k, _ []byte) error {
+			files = append(files, string(k))
+			return nil
+		})
+	})
+	return files, err
+}
+
+func (s *boltStore) DropSwarm(fileName string) ([]string, error) {
+	var ids []string
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		swarm := tx.Bucket(bucketSwarms).Bucket([]byte(fileName))
+		if swarm == nil {
+			return nil
+		}
+		err := swarm.ForEach(func(k, _ []byte) error {
+			ids = append(ids, string(k))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if joined := tx.Bucket(bucketJoined).Bucket([]byte(id)); joined != nil {
+				if err = joined.Delete([]byte(fileName)); err != nil {
+					return err
+				}
+			}
+		}
+		err = tx.Bucket(bucketSwarms).DeleteBucket([]byte(fileName))
+		if errors.Is(err, bolt.ErrBucketNotFound) {
+			return nil
+		}
+		return err
+	})
+	return ids, err
+}
+
+func (s *boltStore) PutBan(b Ban) error {
+	buf, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).Put([]byte(b.Kind+":"+b.Value), buf)
+	})
+}
+
+func (s *boltStore) DeleteBan(kind, value string) (bool, error) {
+	var ok bool
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		key := []byte(kind + ":" + value)
+		ok = tx.Bucket(bucketBans).Get(key) != nil
+		return tx.Bucket(bucketBans).Delete(key)
+	})
+	return ok, err
+}
+
+func (s *boltStore) Bans() ([]Ban, error) {
+	var bans []Ban
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketBans).ForEach(func(_, v []byte) error {
+			var b Ban
+			if err := json.Unmarshal(v, &b); err != nil {
+				return err
+			}
+			bans = append(bans, b)
+			return nil
+		})
+	})
+	return bans, err
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
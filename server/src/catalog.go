@@ -0,0 +1,113 @@
+package src
+
+//文件目录。客户端不知道文件名的时候，可以先查询服务器上有哪些文件。
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultPageSize = 20
+	maxPageSize     = 100
+)
+
+// 文件目录中的一项
+type catalogItem struct {
+	FileName  string `json:"file_name"`
+	FileSize  int    `json:"file_size"`
+	PieceNum  int    `json:"piece_num"`
+	PieceSize int    `json:"piece_size"`
+	IsDir     bool   `json:"is_dir"`
+	Seeders   int    `json:"seeders"`  //当前拥有此文件的客户端数目
+	ModTime   string `json:"mod_time"` //文件的修改时间
+	AddedAt   string `json:"added_at"` //开始做种的时间
+}
+
+// 各个排序字段的比较函数
+var catalogSorts = map[string]func(a, b *catalogItem) bool{
+	"name":     func(a, b *catalogItem) bool { return a.FileName < b.FileName },
+	"size":     func(a, b *catalogItem) bool { return a.FileSize < b.FileSize },
+	"pieces":   func(a, b *catalogItem) bool { return a.PieceNum < b.PieceNum },
+	"seeders":  func(a, b *catalogItem) bool { return a.Seeders < b.Seeders },
+	"mod_time": func(a, b *catalogItem) bool { return a.ModTime < b.ModTime },
+	"added_at": func(a, b *catalogItem) bool { return a.AddedAt < b.AddedAt },
+}
+
+// 返回文件列表，支持分页、排序和按文件名过滤
+// 参数：page（从1开始）、page_size、sort（name/size/pieces/seeders/mod_time/added_at）、order（asc/desc）、name（文件名包含的关键字，不区分大小写）
+func listFiles(c *gin.Context) {
+	page, err := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if err != nil || page < 1 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "page格式错误",
+		})
+		return
+	}
+	pageSize, err := strconv.Atoi(c.DefaultQuery("page_size", strconv.Itoa(defaultPageSize)))
+	if err != nil || pageSize < 1 || pageSize > maxPageSize {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "page_size必须在1~" + strconv.Itoa(maxPageSize) + "之间",
+		})
+		return
+	}
+	less, ok := catalogSorts[c.DefaultQuery("sort", "name")]
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "sort格式错误",
+		})
+		return
+	}
+	order := c.DefaultQuery("order", "asc")
+	if order != "asc" && order != "desc" {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "order格式错误",
+		})
+		return
+	}
+	keyword := strings.ToLower(c.Query("name"))
+
+	items := make([]*catalogItem, 0)
+	for _, info := range tracker.Files() {
+		if keyword != "" && !strings.Contains(strings.ToLower(info.FileName), keyword) {
+			continue
+		}
+		items = append(items, &catalogItem{
+			FileName:  info.FileName,
+			FileSize:  info.FileSize,
+			PieceNum:  info.FilePiecesNum,
+			PieceSize: info.PieceSize,
+			IsDir:     info.IsDir(),
+			Seeders:   tracker.SeederCount(info.FileName),
+			ModTime:   time.Unix(0, info.ModTime).UTC().Format(time.RFC3339),
+			AddedAt:   info.addedAt.UTC().Format(time.RFC3339),
+		})
+	}
+	sort.SliceStable(items, func(i, j int) bool {
+		if order == "desc" {
+			return less(items[j], items[i])
+		}
+		return less(items[i], items[j])
+	})
+
+	total := len(items)
+	start := (page - 1) * pageSize
+	if start > total {
+		start = total
+	}
+	end := start + pageSize
+	if end > total {
+		end = total
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"total":     total,
+		"page":      page,
+		"page_size": pageSize,
+		"files":     items[start:end],
+	})
+}
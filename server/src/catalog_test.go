@@ -0,0 +1,84 @@
+package src
+
+import (
+	"Gdown/god"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 调用listFiles，返回状态码和解析后的响应
+func queryFiles(t *testing.T, query string) (int, struct {
+	Total int           `json:"total"`
+	Files []catalogItem `json:"files"`
+}) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodGet, "/files?"+query, nil)
+	listFiles(c)
+	var resp struct {
+		Total int           `json:"total"`
+		Files []catalogItem `json:"files"`
+	}
+	if w.Code == http.StatusOK {
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return w.Code, resp
+}
+
+func TestListFiles(t *testing.T) {
+	setupShare(t)
+	for i, name := range []string{"Alpha.zip", "beta.iso", "gamma.zip", "delta.txt", "epsilon.ZIP"} {
+		info := &FileInfo{Meta: god.Meta{FileName: name, FileSize: (i + 1) * 100, PieceSize: 256 * 1024, FilePiecesNum: 1}}
+		tracker.PutFile(info)
+	}
+
+	names := func(files []catalogItem) []string {
+		out := make([]string, len(files))
+		for i, f := range files {
+			out[i] = f.FileName
+		}
+		return out
+	}
+	tests := []struct {
+		query string
+		total int
+		want  []string
+	}{
+		{"page=1&page_size=2", 5, []string{"Alpha.zip", "beta.iso"}},
+		{"page=3&page_size=2", 5, []string{"gamma.zip"}},
+		{"page=4&page_size=2", 5, []string{}},                              //超出最后一页返回空列表
+		{"name=zip", 3, []string{"Alpha.zip", "epsilon.ZIP", "gamma.zip"}}, //关键字不区分大小写
+		{"name=zip&page=2&page_size=2", 3, []string{"gamma.zip"}},
+		{"name=nothing", 0, []string{}},
+		{"sort=size&order=desc&page_size=2", 5, []string{"epsilon.ZIP", "delta.txt"}},
+	}
+	for _, tt := range tests {
+		code, resp := queryFiles(t, tt.query)
+		if code != http.StatusOK {
+			t.Fatalf("%s：状态码%d", tt.query, code)
+		}
+		got := names(resp.Files)
+		if resp.Total != tt.total || len(got) != len(tt.want) {
+			t.Fatalf("%s：total=%d files=%v，期望total=%d files=%v", tt.query, resp.Total, got, tt.total, tt.want)
+		}
+		for i := range got {
+			if got[i] != tt.want[i] {
+				t.Fatalf("%s：files=%v，期望%v", tt.query, got, tt.want)
+			}
+		}
+	}
+
+	for _, query := range []string{"page=0", "page=x", "page_size=0", "page_size=101", "sort=color", "order=up"} {
+		if code, _ := queryFiles(t, query); code != http.StatusBadRequest {
+			t.Errorf("%s：期望400，实际%d", query, code)
+		}
+	}
+}
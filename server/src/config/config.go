@@ -0,0 +1,275 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+//服务端配置文件管理。
+//配置文件的格式为toml，和客户端一样使用viper。优先级从高到低：命令行参数、环境变量（GDOWN_前缀）、配置文件、默认值。
+
+// Config 配置文件结构
+type Config struct {
+	Port              int               `mapstructure:"port"`               //监听端口
+	FileDir           string            `mapstructure:"file_dir"`           //存放分享文件的目录
+	FileInfoDir       string            `mapstructure:"file_info_dir"`      //存放.god元数据文件的目录
+	MysqlDSN          string            `mapstructure:"mysql_dsn"`          //MySQL连接串
+	TokenSecret       string            `mapstructure:"token_secret"`       //token jwt秘钥，用于没有kid的token
+	TokenKeys         map[string]string `mapstructure:"token_keys"`         //其它jwt秘钥，kid -> 秘钥。轮换秘钥时旧秘钥留在这里，直到用它签发的token都过期
+	TokenKeyID        string            `mapstructure:"token_key_id"`       //签发新token用的kid，为空时用token_secret
+	AccessTokenTTL    time.Duration     `mapstructure:"access_token_ttl"`   //access token的有效期
+	RefreshTokenTTL   time.Duration     `mapstructure:"refresh_token_ttl"`  //refresh token的有效期，过期后需要重新登录
+	HeartbeatInterval time.Duration     `mapstructure:"heartbeat_interval"` //向客户端发送心跳的间隔
+	HeartbeatTimeout  time.Duration     `mapstructure:"heartbeat_timeout"`  //超过这么久没有收到客户端的消息，视为断线
+	PieceSize         int               `mapstructure:"piece_size"`         //指定分片大小，为0时根据文件大小自动选择
+	Rehash            bool              `mapstructure:"rehash"`             //忽略已有的.god文件，重新计算所有文件的哈希值
+	TrackerStore      string            `mapstructure:"tracker_store"`      //追踪器的存储后端，memory或bolt
+	TrackerDB         string            `mapstructure:"tracker_db"`         //bolt存储的数据库文件
+	PeerTTL           time.Duration     `mapstructure:"peer_ttl"`           //客户端离线超过这么久，从追踪器中清理
+	Admins            []string          `mapstructure:"admins"`             //管理员用户名，可以使用/admin接口
+	ShutdownTimeout   time.Duration     `mapstructure:"shutdown_timeout"`   //关闭时等待正在处理的请求的最长时间
+	UploadRate        int               `mapstructure:"upload_rate"`        //全部上传的速度上限（字节每秒），为0时不限
+	PeerUploadRate    int               `mapstructure:"peer_upload_rate"`   //每个客户端的上传速度上限，为0时不限
+	UserUploadRate    int               `mapstructure:"user_upload_rate"`   //每个用户的上传速度上限，为0时不限
+	MaxUploads        int               `mapstructure:"max_uploads"`        //同时传输的分片数上限，超过时返回503，为0时不限
+	MaxPeerUploads    int               `mapstructure:"max_peer_uploads"`   //每个客户端同时传输的分片数上限，为0时不限
+	TicketKey         string            `mapstructure:"ticket_key"`         //签发p2p访问凭证的私钥文件，不存在时自动生成
+	TicketTTL         time.Duration     `mapstructure:"ticket_ttl"`         //p2p访问凭证的有效期
+	MetricsAddr       string            `mapstructure:"metrics_addr"`       //监控指标的监听地址，和下载服务分开，为空时不提供
+	MetricsFileLabel  bool              `mapstructure:"metrics_file_label"` //按文件名导出swarm的客户端数目，文件多时指标会很多
+	TrustedProxies    []string          `mapstructure:"trusted_proxies"`    //信任的反向代理（IP或CIDR），只有来自它们的X-Forwarded-For才会被采用
+}
+
+const (
+	minPieceSize = 16 * 1024          //手动指定分片大小时的下限
+	maxPieceSize = 1024 * 1024 * 1024 //手动指定分片大小时的上限
+)
+
+// Cfg 当前使用的配置。没有读取配置文件时为默认值
+var Cfg = Default()
+
+// Default 默认配置
+func Default() Config {
+	return Config{
+		Port:              8080,
+		FileDir:           "./file",
+		FileInfoDir:       "./fileInfo",
+		AccessTokenTTL:    15 * time.Minute,
+		RefreshTokenTTL:   7 * 24 * time.Hour,
+		HeartbeatInterval: 60 * time.Second,
+		HeartbeatTimeout:  125 * time.Second,
+		TrackerStore:      "memory",
+		TrackerDB:         "./tracker.db",
+		PeerTTL:           30 * time.Minute,
+		ShutdownTimeout:   30 * time.Second,
+		MaxUploads:        64,
+		MaxPeerUploads:    8,
+		TicketKey:         "./ticket.key",
+		TicketTTL:         10 * time.Minute,
+		MetricsAddr:       "127.0.0.1:8081",
+	}
+}
+
+// ReadConfig 读取命令行参数、环境变量和配置文件，校验之后写入Cfg。出错时直接退出
+func ReadConfig() {
+	cfg, err := load(os.Args[1:])
+	if err != nil {
+		log.Fatalf("读取配置文件错误:%v", err)
+	}
+	if err = cfg.Validate(); err != nil {
+		log.Fatalf("配置错误:%v", err)
+	}
+	Cfg = cfg
+}
+
+func load(args []string) (Config, error) {
+	def := Default()
+	flags := pflag.NewFlagSet("server", pflag.ContinueOnError)
+	path := flags.String("config", "./config.toml", "配置文件路径")
+	flags.Int("port", def.Port, "监听端口")
+	flags.String("file-dir", def.FileDir, "存放分享文件的目录")
+	flags.String("file-info-dir", def.FileInfoDir, "存放.god元数据文件的目录")
+	flags.String("mysql-dsn", def.MysqlDSN, "MySQL连接串")
+	flags.String("token-secret", def.TokenSecret, "token jwt秘钥")
+	flags.StringToString("token-keys", def.TokenKeys, "其它jwt秘钥，格式为kid=秘钥，多个用逗号分隔")
+	flags.String("token-key-id", def.TokenKeyID, "签发新token用的kid，为空时用token_secret")
+	flags.Duration("access-token-ttl", def.AccessTokenTTL, "access token的有效期")
+	flags.Duration("refresh-token-ttl", def.RefreshTokenTTL, "refresh token的有效期，过期后需要重新登录")
+	flags.Duration("heartbeat-interval", def.HeartbeatInterval, "向客户端发送心跳的间隔")
+	flags.Duration("heartbeat-timeout", def.HeartbeatTimeout, "超过这么久没有收到客户端的消息，视为断线")
+	flags.Int("piece-size", def.PieceSize, "分片大小（字节），为0时根据文件大小自动选择")
+	flags.Bool("rehash", def.Rehash, "忽略已有的.god文件，重新计算所有文件的哈希值")
+	flags.String("tracker-store", def.TrackerStore, "追踪器的存储后端，memory或bolt")
+	flags.String("tracker-db", def.TrackerDB, "bolt存储的数据库文件")
+	flags.Duration("peer-ttl", def.PeerTTL, "客户端离线超过这么久，从追踪器中清理")
+	flags.StringSlice("admins", def.Admins, "管理员用户名，多个用逗号分隔")
+	flags.Duration("shutdown-timeout", def.ShutdownTimeout, "关闭时等待正在处理的请求的最长时间")
+	flags.Int("upload-rate", def.UploadRate, "全部上传的速度上限（字节每秒），为0时不限")
+	flags.Int("peer-upload-rate", def.PeerUploadRate, "每个客户端的上传速度上限（字节每秒），为0时不限")
+	flags.Int("user-upload-rate", def.UserUploadRate, "每个用户的上传速度上限（字节每秒），为0时不限")
+	flags.Int("max-uploads", def.MaxUploads, "同时传输的分片数上限，为0时不限")
+	flags.Int("max-peer-uploads", def.MaxPeerUploads, "每个客户端同时传输的分片数上限，为0时不限")
+	flags.String("ticket-key", def.TicketKey, "签发p2p访问凭证的私钥文件，不存在时自动生成")
+	flags.Duration("ticket-ttl", def.TicketTTL, "p2p访问凭证的有效期")
+	flags.String("metrics-addr", def.MetricsAddr, "监控指标的监听地址，为空时不提供")
+	flags.StringSlice("trusted-proxies", def.TrustedProxies, "信任的反向代理（IP或CIDR），多个用逗号分隔")
+	flags.Bool("metrics-file-label", def.MetricsFileLabel, "按文件名导出swarm的客户端数目")
+	if err := flags.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	v := viper.New()
+	v.SetConfigFile(*path)
+	v.SetConfigType("toml")
+	v.SetEnvPrefix("GDOWN")
+	v.SetEnvKeyReplacer(strings.NewReplacer("-", "_"))
+	v.AutomaticEnv()
+	//命令行参数用-分隔，配置文件和环境变量用_分隔
+	var bindErr error
+	flags.VisitAll(func(f *pflag.Flag) {
+		if f.Name == "config" {
+			return
+		}
+		if err := v.BindPFlag(strings.ReplaceAll(f.Name, "-", "_"), f); err != nil && bindErr == nil {
+			bindErr = err
+		}
+	})
+	if bindErr != nil {
+		return Config{}, bindErr
+	}
+
+	err := v.ReadInConfig()
+	var notFound viper.ConfigFileNotFoundError
+	if errors.As(err, &notFound) || errors.Is(err, os.ErrNotExist) {
+		log.Println("未找到配置文件", *path, "，使用默认配置")
+	} else if err != nil {
+		return Config{}, err
+	}
+
+	cfg := def
+	if err = v.Unmarshal(&cfg); err != nil {
+		return Config{}, err
+	}
+	return cfg, nil
+}
+
+// Validate 校验配置，返回所有不合法的项
+func (c *Config) Validate() error {
+	var problems []string
+	if c.Port <= 0 || c.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port必须在1~65535之间，当前为%d", c.Port))
+	}
+	if err := checkDir(c.FileDir); err != nil {
+		problems = append(problems, "file_dir "+err.Error())
+	}
+	if err := checkDir(c.FileInfoDir); err != nil {
+		problems = append(problems, "file_info_dir "+err.Error())
+	}
+	if c.MysqlDSN == "" {
+		problems = append(problems, "mysql_dsn不能为空")
+	}
+	if len(c.TokenSecret) < 32 {
+		problems = append(problems, "token_secret长度不能少于32个字符")
+	}
+	kids := make([]string, 0, len(c.TokenKeys))
+	for kid := range c.TokenKeys {
+		kids = append(kids, kid)
+	}
+	sort.Strings(kids)
+	for _, kid := range kids {
+		if len(c.TokenKeys[kid]) < 32 {
+			problems = append(problems, fmt.Sprintf("token_keys中%s的秘钥长度不能少于32个字符", kid))
+		}
+	}
+	if _, ok := c.TokenKeys[c.TokenKeyID]; c.TokenKeyID != "" && !ok {
+		problems = append(problems, fmt.Sprintf("token_key_id为%q，但token_keys中没有这个秘钥", c.TokenKeyID))
+	}
+	if c.AccessTokenTTL < time.Minute {
+		problems = append(problems, "access_token_ttl不能小于1分钟")
+	}
+	if c.RefreshTokenTTL <= c.AccessTokenTTL {
+		problems = append(problems, "refresh_token_ttl必须大于access_token_ttl")
+	}
+	if c.HeartbeatInterval <= 0 {
+		problems = append(problems, "heartbeat_interval必须大于0")
+	}
+	if c.HeartbeatTimeout <= c.HeartbeatInterval {
+		problems = append(problems, "heartbeat_timeout必须大于heartbeat_interval")
+	}
+	if c.PieceSize != 0 && (c.PieceSize < minPieceSize || c.PieceSize > maxPieceSize) {
+		problems = append(problems, fmt.Sprintf("piece_size为0或者在%d~%d之间，当前为%d", minPieceSize, maxPieceSize, c.PieceSize))
+	}
+	switch c.TrackerStore {
+	case "memory":
+	case "bolt":
+		if c.TrackerDB == "" {
+			problems = append(problems, "tracker_store为bolt时tracker_db不能为空")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("tracker_store只能是memory或bolt，当前为%q", c.TrackerStore))
+	}
+	if c.ShutdownTimeout <= 0 {
+		problems = append(problems, "shutdown_timeout必须大于0")
+	}
+	for _, limit := range []struct {
+		name  string
+		value int
+	}{
+		{"upload_rate", c.UploadRate},
+		{"peer_upload_rate", c.PeerUploadRate},
+		{"user_upload_rate", c.UserUploadRate},
+		{"max_uploads", c.MaxUploads},
+		{"max_peer_uploads", c.MaxPeerUploads},
+	} {
+		if limit.value < 0 {
+			problems = append(problems, fmt.Sprintf("%s不能小于0，当前为%d", limit.name, limit.value))
+		}
+	}
+	if c.TicketKey == "" {
+		problems = append(problems, "ticket_key不能为空")
+	}
+	if c.TicketTTL < time.Minute {
+		problems = append(problems, "ticket_ttl不能小于1分钟")
+	}
+	if c.PeerTTL < time.Minute {
+		problems = append(problems, "peer_ttl不能小于1分钟")
+	}
+	if c.MetricsAddr != "" {
+		if _, _, err := net.SplitHostPort(c.MetricsAddr); err != nil {
+			problems = append(problems, fmt.Sprintf("metrics_addr格式错误：%v", err))
+		}
+	}
+	for _, p := range c.TrustedProxies {
+		if _, _, err := net.ParseCIDR(p); err != nil && net.ParseIP(p) == nil {
+			problems = append(problems, fmt.Sprintf("trusted_proxies中的%q不是IP或CIDR", p))
+		}
+	}
+	if len(problems) != 0 {
+		return errors.New(strings.Join(problems, "；"))
+	}
+	return nil
+}
+
+// 目录必须存在
+func checkDir(dir string) error {
+	if dir == "" {
+		return errors.New("不能为空")
+	}
+	stat, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("无法访问：%v", err)
+	}
+	if !stat.IsDir() {
+		return fmt.Errorf("%s不是目录", dir)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+package src
+
+//websocket上的控制消息。消息格式见protocol包。
+//每个连接一个goroutine读取消息，一个goroutine定时发送心跳，一个goroutine从发送队列里取消息写入连接。
+//send只是把消息放进队列，不会因为某个客户端网络慢而卡住读取循环或者其它客户端；队列满了说明客户端跟不上，直接断开。
+
+import (
+	"Gdown/protocol"
+	"Gdown/server/src/config"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const sendQueueSize = 256 //每个客户端发送队列的长度
+
+var errSendQueueFull = errors.New("发送队列已满，客户端跟不上，断开连接")
+
+// 向客户端发送一条控制消息。消息放进发送队列后立即返回，队列满时断开连接
+func (cli *client) send(t protocol.Type, data any) error {
+	buf, err := protocol.New(t, data)
+	if err != nil {
+		return err
+	}
+	return cli.enqueue(buf)
+}
+
+// buf为nil表示之前的消息发完之后关闭连接
+func (cli *client) enqueue(buf []byte) error {
+	select {
+	case cli.out <- buf:
+		return nil
+	default:
+		cli.conn.Close() //serve会因为读取失败而退出
+		return errSendQueueFull
+	}
+}
+
+// 从发送队列取消息写入连接，直到done关闭。写入失败时关闭连接，让serve退出
+func writeLoop(cli *client, done <-chan struct{}) {
+	for {
+		select {
+		case <-done:
+			return
+		case buf := <-cli.out:
+			if buf == nil {
+				cli.conn.Close()
+				return
+			}
+			cli.writeMu.Lock()
+			err := cli.conn.SetWriteDeadline(time.Now().Add(config.Cfg.HeartbeatInterval))
+			if err == nil {
+				err = cli.conn.WriteMessage(websocket.TextMessage, buf)
+			}
+			cli.writeMu.Unlock()
+			if err != nil {
+				log.Println("向客户端", cli.ID, "发送消息失败：", err)
+				cli.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// 发送关闭帧再关闭连接，客户端能分清是服务器主动断开还是网络故障
+func (cli *client) close(code int, reason string) {
+	cli.writeMu.Lock()
+	err := cli.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(time.Second))
+	cli.writeMu.Unlock()
+	if err != nil && !errors.Is(err, websocket.ErrCloseSent) {
+		log.Println("向客户端", cli.ID, "发送关闭帧失败：", err)
+	}
+	cli.conn.Close()
+}
+
+// 处理客户端的消息，直到连接断开。超过heartbeat_timeout没有收到任何消息视为断线
+func serve(cli *client) {
+	conn := cli.conn
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+	go keepAlive(cli, done)
+	go writeLoop(cli, done)
+
+	for {
+		err := conn.SetReadDeadline(time.Now().Add(config.Cfg.HeartbeatTimeout)) //重置读取截止时间
+		if err != nil {
+			log.Println("设置读取截止时间失败：", err)
+			return
+		}
+		typ, buf, err := conn.ReadMessage()
+		if err != nil {
+			log.Println("客户端", cli.ID, "断线：", err)
+			return
+		}
+		if typ != websocket.TextMessage {
+			continue
+		}
+		if !handleMessage(cli, buf) {
+			return
+		}
+	}
+}
+
+// 定时发送心跳，直到done关闭。发送失败时连接已经被关闭，serve会随之退出
+func keepAlive(cli *client, done <-chan struct{}) {
+	ticker := time.NewTicker(config.Cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := cli.send(protocol.TypePing, nil); err != nil {
+				log.Println("向客户端", cli.ID, "发送心跳失败：", err)
+				return
+			}
+		}
+	}
+}
+
+// 处理一条消息，返回false时断开连接
+func handleMessage(cli *client, buf []byte) bool {
+	msg, err := protocol.Parse(buf)
+	if err != nil {
+		cli.sendError("", "消息格式错误："+err.Error())
+		return true
+	}
+	switch msg.Type {
+	case protocol.TypePong:
+	case protocol.TypeHello:
+		var hello protocol.Hello
+		if err = msg.Decode(&hello); err != nil {
+			cli.sendError(msg.Type, err.Error())
+			return true
+		}
+		if hello.Version != protocol.Version {
+			cli.sendError(msg.Type, "协议版本不一致，请更新客户端")
+			cli.enqueue(nil) //错误消息发出去之后再断开
+			return true
+		}
+		if err = cli.send(protocol.TypeWelcome, protocol.Welcome{Version: protocol.Version, IP: cli.host(), TicketKey: ticketPublicKey()}); err != nil {
+			log.Println("回复客户端", cli.ID, "失败：", err)
+			return false
+		}
+		joinFiles(cli, hello.Files)
+	case protocol.TypeHave:
+		var have protocol.Have
+		if err = msg.Decode(&have); err != nil {
+			cli.sendError(msg.Type, err.Error())
+			return true
+		}
+		err = tracker.Have(have.FileName, cli.ID, have.Pieces)
+		if err != nil && !errors.Is(err, ErrExcluded) { //被移出的客户端每个分片都会发have，不逐个回复
+			cli.sendError(msg.Type, err.Error())
+		}
+	case protocol.TypeComplete:
+		var f protocol.File
+		if err = msg.Decode(&f); err != nil {
+			cli.sendError(msg.Type, err.Error())
+			return true
+		}
+		joinFiles(cli, []string{f.FileName})
+	case protocol.TypeRemove:
+		var f protocol.File
+		if err = msg.Decode(&f); err != nil {
+			cli.sendError(msg.Type, err.Error())
+			return true
+		}
+		if _, err = tracker.Leave(f.FileName, cli.ID); err != nil {
+			log.Println("客户端", cli.ID, "退出", f.FileName, "的swarm失败：", err)
+		}
+	case protocol.TypeError:
+		var e protocol.Error
+		if msg.Decode(&e) == nil {
+			log.Println("客户端", cli.ID, "报告错误：", e.Type, e.Message)
+		}
+	default:
+		cli.sendError(msg.Type, "不支持的消息类型")
+	}
+	return true
+}
+
+// 记录客户端拥有这些文件的全部分片，服务器上没有的文件提示客户端
+func joinFiles(cli *client, files []string) {
+	for _, fileName := range files {
+		if _, ok := tracker.File(fileName); !ok {
+			cli.sendNotice(fileName + "不在服务器上，不会被分享给其它客户端")
+			continue
+		}
+		if err := tracker.Complete(fileName, cli.ID); err != nil && !errors.Is(err, ErrExcluded) {
+			log.Println("客户端", cli.ID, "加入", fileName, "的swarm失败：", err)
+		}
+	}
+}
+
+// 回复错误消息，发送失败只记录日志
+func (cli *client) sendError(t protocol.Type, message string) {
+	if err := cli.send(protocol.TypeError, protocol.Error{Type: t, Message: message}); err != nil {
+		log.Println("向客户端", cli.ID, "发送错误消息失败：", err)
+	}
+}
+
+// 发送提示消息，发送失败只记录日志
+func (cli *client) sendNotice(message string) {
+	if err := cli.send(protocol.TypeNotice, protocol.Notice{Message: message}); err != nil {
+		log.Println("向客户端", cli.ID, "发送提示失败：", err)
+	}
+}
@@ -1,7 +1,14 @@
 package src
 
 import (
+	"Gdown/god"
+	"Gdown/protocol"
+	"errors"
+	"io"
+	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -24,7 +31,7 @@ func sendMetaDate(c *gin.Context) {
 	fileName := request.FileName
 
 	//检查文件名是否存在在文件列表中
-	fileInfo, ok := fileLists[fileName]
+	fileInfo, ok := tracker.File(fileName)
 	if !ok {
 		c.JSON(404, gin.H{
 			"message": "文件不存在",
@@ -32,7 +39,7 @@ func sendMetaDate(c *gin.Context) {
 		return
 	}
 	//获取文件的元数据文件
-	file, err := os.ReadFile("./fileInfo/" + fileName + ".god")
+	file, err := os.ReadFile(godPath(fileName))
 	if err != nil {
 		c.JSON(500, gin.H{
 			"message": "服务器内部错误",
@@ -40,33 +47,51 @@ func sendMetaDate(c *gin.Context) {
 		return
 	}
 
-	ip := c.ClientIP() + ":" + c.GetHeader("X-User-Port") //获取客户端的ip地址
-	//在客户端列表中添加此文件
-	client, ok := clientList[ip]
-	if !ok {
-		c.JSON(403, gin.H{
-			"message": "客户端未建立连接",
+	cli := requestPeer(c)
+
+	//将此客户端加入到文件的swarm当中去，再获取其它拥有此文件分片的客户端。被移出swarm的客户端仍然可以下载，只是不会被推荐给别人
+	var peers []protocol.Peer
+	err = tracker.Join(fileName, cli.ID)
+	if errors.Is(err, ErrExcluded) {
+		err = nil
+	}
+	if err == nil {
+		peers, err = tracker.Seeders(fileName, cli.ID)
+	}
+	if err != nil {
+		log.Println(fileName, "更新客户端列表失败：", err)
+		c.JSON(500, gin.H{
+			"message": "服务器内部错误",
 		})
 		return
 	}
-	client.DownFileList[fileName] = fileInfo //将此文件加入到客户端的下载文件列表当中去
-
-	//将此客户端的ip地址加入到文件的ip列表当中去
-	fileLists[fileName].ipAdr.Store(ip, true)
-	//获取拥有此文件的客户端的IP地址
-	var ipAdr []string
-	fileLists[fileName].ipAdr.Range(func(key, value interface{}) bool {
-		ipAdr = append(ipAdr, key.(string))
-		return true
-	})
+	//签发向其它客户端请求分片用的凭证
+	ticket, expires, err := issueTicket(cli, fileName)
+	if err != nil {
+		log.Println(fileName, "签发凭证失败：", err)
+		c.JSON(500, gin.H{
+			"message": "服务器内部错误",
+		})
+		return
+	}
+	ipAdr := make([]string, 0, len(peers)) //兼容旧客户端
+	for _, p := range peers {
+		ipAdr = append(ipAdr, p.Addr)
+	}
 	//发送文件的元数据
 	c.JSON(200, gin.H{
-		"message": file,
-		"ip_adr":  ipAdr,
+		"message":        file,
+		"root":           fileInfo.ID(), //文件的身份标识
+		"ip_adr":         ipAdr,
+		"peers":          peers, //每个客户端拥有哪些分片
+		"ticket":         ticket,
+		"ticket_expires": expires.Unix(),
 	})
 }
 
 // 向客户端发送请求的文件数据片段
+// Range只能落在一个分片之内，可以是分片的任意一段。成功时返回206，数据直接从文件流式发送，
+// 不经过用户态缓冲区（单个文件时可以走sendfile）
 func sendFilePiece(c *gin.Context) {
 	//获取客户端请求的文件名
 	var request struct {
@@ -74,88 +99,173 @@ func sendFilePiece(c *gin.Context) {
 	}
 	err := c.BindJSON(&request)
 	if err != nil {
-		c.JSON(400, gin.H{
+		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "请求格式错误",
 		})
 		return
 	}
 	fileName := request.FileName
 
-	fileRange := c.GetHeader("Range") //获取客户端请求的文件片段
 	//检查文件名是否存在在文件列表中
-	fileInformation, ok := fileLists[fileName]
+	fileInformation, ok := tracker.File(fileName)
 	if !ok {
-		c.JSON(404, gin.H{
+		c.JSON(http.StatusNotFound, gin.H{
 			"message": "文件不存在",
 		})
 		return
 	}
-	//解析文件的range，获取开头
-	start, ok := getPieceStart(fileRange)
-	if !ok {
-		c.JSON(400, gin.H{
+
+	//解析文件的range
+	total := int64(fileInformation.FileSize)
+	start, end, err := parseRange(c.GetHeader("Range"), total)
+	if errors.Is(err, errRangeNotSatisfiable) {
+		c.Header("Content-Range", "bytes */"+strconv.FormatInt(total, 10))
+		c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{
+			"message": "range超出文件范围",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
 			"message": "range格式错误",
 		})
 		return
 	}
-	//检查start是否在map当中
-	p, ok := fileInformation.filePiecesByStart[start]
+	//range不能跨越分片
+	p := fileInformation.FilePieces[start/int64(fileInformation.PieceSize)]
+	if end == -1 {
+		end = int64(p.PieceStart+p.PieceSize) - 1 //没有指定结尾时，发送到分片末尾
+	}
+	if end >= int64(p.PieceStart+p.PieceSize) {
+		c.Header("Content-Range", "bytes */"+strconv.FormatInt(total, 10))
+		c.JSON(http.StatusRequestedRangeNotSatisfiable, gin.H{
+			"message": "range跨越了分片",
+		})
+		return
+	}
+
+	//占用上传额度，同时传输的分片太多时让客户端稍后再来
+	cli := requestPeer(c)
+	slot, ok := uploads.acquire(cli.ID, cli.User)
 	if !ok {
-		c.JSON(400, gin.H{
-			"message": "range格式错误",
+		c.Header("Retry-After", strconv.Itoa(uploads.retryAfter(p.PieceSize)))
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"message": "服务器繁忙，请稍后重试",
 		})
 		return
 	}
-	//获取文件的片段
-	filePiece := getFilePiece(fileName, start, p.PieceSize)
+	defer slot.release()
+
+	//先打开要用到的所有文件，出错时还能返回错误状态码
+	entries := fileInformation.Entries()
+	segs := god.Segments(entries, start, end-start+1)
+	files := make([]*cachedFile, 0, len(segs))
+	defer func() {
+		for _, f := range files {
+			handles.put(f)
+		}
+	}()
+	for _, seg := range segs {
+		f, err := handles.get(shareFilePath(fileInformation, entries[seg.Index]))
+		if err != nil {
+			log.Println(fileName, "打开文件失败：", err)
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "服务器内部错误",
+			})
+			return
+		}
+		files = append(files, f)
+	}
+
 	//发送文件的片段
-	c.Data(200, "application/octet-stream", filePiece)
+	c.Header("Content-Type", "application/octet-stream")
+	c.Header("Content-Range", "bytes "+strconv.FormatInt(start, 10)+"-"+strconv.FormatInt(end, 10)+"/"+strconv.FormatInt(total, 10))
+	c.Header("Content-Length", strconv.FormatInt(end-start+1, 10))
+	c.Status(http.StatusPartialContent)
+	c.Writer.WriteHeaderNow()
+	var w io.Writer = c.Writer
+	if u, ok := c.Writer.(interface{ Unwrap() http.ResponseWriter }); ok {
+		w = u.Unwrap() //gin的ResponseWriter没有实现ReaderFrom，直接写底层连接才能用上sendfile
+	}
+	for i, seg := range segs {
+		var n int64
+		if _, err = files[i].Seek(seg.Offset, io.SeekStart); err == nil {
+			var r io.Reader = io.LimitReader(files[i].File, seg.Length)
+			if slot.throttled() {
+				r = slot.reader(r) //限速时只能分块发送，用不上sendfile
+			}
+			n, err = io.Copy(w, r)
+		}
+		bytesServed.Add(float64(n))
+		if err != nil {
+			//响应头已经发出去了，只能中断连接，客户端会因为长度不足而失败
+			log.Println(fileName, "发送分片失败：", err)
+			files[i].broken = true
+			c.Abort()
+			return
+		}
+	}
+	piecesServed.Inc()
 }
 
-// 解析range
-// 返回range的开头，另返回一个布尔值，代表是否解析成功
-func getPieceStart(fileRange string) (int, bool) {
-	// 确保 range 头不为空
-	if fileRange == "" {
-		return 0, false
+// 分享中某个文件的路径
+func shareFilePath(info *FileInfo, e *god.Entry) string {
+	if e.Path == "" {
+		return filePath(info.FileName)
 	}
+	return filepath.Join(filePath(info.FileName), filepath.FromSlash(e.Path))
+}
 
+var (
+	errBadRange            = errors.New("range格式错误")
+	errRangeNotSatisfiable = errors.New("range超出文件范围")
+)
+
+// 解析range，只支持单个范围。返回开头和结尾（包含），没有指定结尾时end为-1。
+// 以'-'开头的表示文件的最后若干字节
+func parseRange(fileRange string, size int64) (start, end int64, err error) {
 	// 判断 range 头是否以 "bytes=" 开头
 	const prefix = "bytes="
 	if !strings.HasPrefix(fileRange, prefix) {
-		return 0, false
+		return 0, 0, errBadRange
 	}
-
 	// 提取 range 头的值
-	rangeValue := strings.TrimPrefix(fileRange, prefix)
-
-	// 如果 range 头以 '-' 开头，表示不指定开头位置
-	if rangeValue[0] == '-' {
-		return 0, true
+	rangeValue := strings.TrimSpace(strings.TrimPrefix(fileRange, prefix))
+	startStr, endStr, ok := strings.Cut(rangeValue, "-")
+	if !ok || strings.Contains(rangeValue, ",") {
+		return 0, 0, errBadRange
 	}
 
-	rangeParts := strings.Split(rangeValue, "-")
-
-	// 解析 range 头的值为整数
-	start, err := strconv.Atoi(rangeParts[0])
-	if err != nil {
-		return 0, false
+	if startStr == "" { //最后若干字节
+		n, err := strconv.ParseInt(endStr, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, errBadRange
+		}
+		if n > size {
+			n = size
+		}
+		if n == 0 {
+			return 0, 0, errRangeNotSatisfiable
+		}
+		return size - n, size - 1, nil
 	}
 
-	return start, true
-}
-
-// 获取指定文件的指定片段
-func getFilePiece(fileName string, pieceStart, pSize int) []byte {
-	file, err := os.Open("./file/" + fileName)
-	if err != nil {
-		return nil
+	start, err = strconv.ParseInt(startStr, 10, 64)
+	if err != nil || start < 0 {
+		return 0, 0, errBadRange
 	}
-	defer file.Close()
-	filePiece := make([]byte, pSize)
-	_, err = file.ReadAt(filePiece, int64(pieceStart))
-	if err != nil {
-		return nil
+	if start >= size {
+		return 0, 0, errRangeNotSatisfiable
+	}
+	if endStr == "" {
+		return start, -1, nil
+	}
+	end, err = strconv.ParseInt(endStr, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, errBadRange
+	}
+	if end >= size {
+		end = size - 1 //结尾超出文件大小时截到文件末尾
 	}
-	return filePiece
+	return start, end, nil
 }
@@ -0,0 +1,43 @@
+package src
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseRange(t *testing.T) {
+	const size = 1000
+	tests := []struct {
+		header     string
+		start, end int64
+		err        error //nil表示成功；errBadRange表示格式错误
+	}{
+		{"bytes=0-99", 0, 99, nil},
+		{"bytes=100-", 100, -1, nil},                  //没有结尾
+		{"bytes=-200", 800, 999, nil},                 //最后200字节
+		{"bytes=-2000", 0, 999, nil},                  //超过文件大小时返回整个文件
+		{"bytes=900-5000", 900, 999, nil},             //结尾超出文件大小
+		{"bytes=1000-", 0, 0, errRangeNotSatisfiable}, //开头超出文件大小
+		{"bytes=0-1,5-9", 0, 0, errBadRange},          //不支持多个范围
+		{"bytes=5-1", 0, 0, errBadRange},
+		{"bytes=-0", 0, 0, errBadRange},
+		{"bytes=a-b", 0, 0, errBadRange},
+		{"bytes=-", 0, 0, errBadRange},
+		{"bytes=10", 0, 0, errBadRange},
+		{"items=0-1", 0, 0, errBadRange},
+		{"", 0, 0, errBadRange},
+	}
+	for _, tt := range tests {
+		start, end, err := parseRange(tt.header, size)
+		switch {
+		case tt.err == nil && err != nil:
+			t.Errorf("%q：意外的错误%v", tt.header, err)
+		case tt.err == errRangeNotSatisfiable && !errors.Is(err, errRangeNotSatisfiable):
+			t.Errorf("%q：期望超出范围，得到%v", tt.header, err)
+		case tt.err == errBadRange && (err == nil || errors.Is(err, errRangeNotSatisfiable)):
+			t.Errorf("%q：期望格式错误，得到%v", tt.header, err)
+		case tt.err == nil && (start != tt.start || end != tt.end):
+			t.Errorf("%q：得到%d-%d，期望%d-%d", tt.header, start, end, tt.start, tt.end)
+		}
+	}
+}
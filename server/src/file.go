@@ -3,90 +3,210 @@ package src
 //处理文件信息，对服务器内文件进行“做种”处理
 
 import (
-	"bytes"
-	"encoding/gob"
-	"hash/crc32"
+	"Gdown/god"
+	"Gdown/server/src/config"
+	"io/fs"
 	"log"
 	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
-const pieceSize = 1024 * 1024 //每个分片的大小
-
-var fileLists = make(map[string]*FileInfo) //维护文件列表
+const (
+	minPieceSize = 256 * 1024       //自动选择时分片的最小值
+	maxPieceSize = 16 * 1024 * 1024 //自动选择时分片的最大值
+	targetPieces = 2048             //自动选择时，尽量让每个文件的分片数不超过这个数
+	hashAlgo     = god.HashSHA256   //分片使用的哈希算法
+)
 
 type FileInfo struct {
-	FileName          string
-	FilePiecesNum     int
-	FileSize          int
-	FilePieces        []*Piece
-	ipAdr             sync.Map       //记录下载此文件的客户端的IP地址。用哈希表是因为查询时间复杂度低，而且这里要保证并发安全性，防止客户端下线的时候读写冲突。
-	filePiecesByStart map[int]*Piece //记录分片的起始位置，用于客户端请求分片的时候进行快速查找
-}
-
-type Piece struct {
-	PieceIndex int    //第几片
-	PieceStart int    //记录分片处在文件的起始位置
-	PieceSize  int    //分片的大小
-	PieceHash  uint32 //分片的哈希值，用于校验
+	god.Meta           //写入.god文件的元数据
+	addedAt  time.Time //开始做种的时间，文件更新后重新计算
 }
 
-// LoadFile 遍历file目录，加载file目录下的文件，并且将它们分片存储，最后格式化为toml配置文件
+// LoadFile 遍历file目录，加载file目录下的文件和目录，并且将它们分片存储，最后写入.god元数据文件
 func LoadFile() {
-	files, err := os.ReadDir("./file")
+	files, err := os.ReadDir(config.Cfg.FileDir)
 	if err != nil {
 		log.Fatalf(err.Error())
 	}
+
+	//多个文件同时处理，分片哈希的并发数由hashSem统一限制
+	var (
+		jobs  = make(chan os.DirEntry)
+		wg    sync.WaitGroup
+		done  atomic.Int64
+		stop  = make(chan struct{})
+		begin = time.Now()
+	)
+	go logProgress(&done, len(files), stop)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range jobs {
+				handelFile(file)
+				done.Add(1)
+			}
+		}()
+	}
 	for _, file := range files {
-		if file.Name() == "README.md" {
-			continue //跳过readme，这东西放文件夹里做提示用的
+		if skipFile(file.Name()) {
+			continue
 		}
-		handelFile(file)
+		jobs <- file
 	}
+	close(jobs)
+	wg.Wait()
+	close(stop)
+	log.Printf("做种完成：共处理%d个文件，耗时%v", done.Load(), time.Since(begin).Round(time.Millisecond))
+}
+
+// 分享文件的路径
+func filePath(name string) string {
+	return filepath.Join(config.Cfg.FileDir, name)
+}
+
+// 元数据文件的路径
+func godPath(name string) string {
+	return filepath.Join(config.Cfg.FileInfoDir, name+".god")
 }
 
-// 处理文件
-func handelFile(f os.DirEntry) {
+// 跳过readme，这东西放文件夹里做提示用的。另外跳过隐藏文件，编辑器和下载工具常用它们做临时文件
+func skipFile(name string) bool {
+	return name == "README.md" || strings.HasPrefix(name, ".")
+}
+
+// 处理文件或目录，返回处理好的文件信息。处理失败时返回nil
+func handelFile(f os.DirEntry) *FileInfo {
 	var info FileInfo
-	info.ipAdr = sync.Map{}
 	info.FileName = f.Name()
-	info.filePiecesByStart = make(map[int]*Piece)
+	info.HashAlgo = hashAlgo
+	info.addedAt = time.Now()
 	fileInfo, err := f.Info()
 	if err != nil {
 		log.Println(info.FileName, "处理错误，获取info失败：", err)
-		return //如果错误直接返回就是
+		return nil //如果错误直接返回就是
+	}
+
+	if f.IsDir() {
+		err = scanDir(&info) //目录分享，记录目录下的所有文件
+		if err != nil {
+			log.Println(info.FileName, "处理错误，遍历目录失败：", err)
+			return nil
+		}
+		if len(info.Files) == 0 {
+			log.Println(info.FileName, "目录为空，跳过")
+			return nil
+		}
+	} else {
+		info.FileSize = int(fileInfo.Size()) //获取文件的大小
+		info.ModTime = fileInfo.ModTime().UnixNano()
 	}
+	info.PieceSize = choosePieceSize(info.FileSize) //分片大小记录在元数据里，客户端据此下载和限速
 
-	info.FileSize = int(fileInfo.Size())                        //获取文件的大小
-	info.FilePiecesNum = chunkFileNum(info.FileSize, pieceSize) //确定文件该分成多少片
-	err = chunkFile(&info, pieceSize)                           //进行分片
+	//文件没有变动的话直接用上次的元数据，不用重新读一遍文件
+	if !config.Cfg.Rehash && loadCachedInfo(&info) {
+		tracker.PutFile(&info)
+		return &info
+	}
+
+	info.FilePiecesNum = chunkFileNum(info.FileSize, info.PieceSize) //确定文件该分成多少片
+	err = chunkFile(&info, info.PieceSize)                           //进行分片
 
 	if err != nil {
-		return
-	}
-	//将文件信息格式化为文件。
-	//TODO:参考https://stackoverflow.com/questions/65842245/what-does-the-error-binary-write-invalid-type-mean,之前尝试用二进制文件存储出错了，查了知道binary包的那个不支持动态的数据写入。
-	buf := new(bytes.Buffer)
-	enc := gob.NewEncoder(buf)
-	if err := enc.Encode(info); err != nil {
-		log.Println(info.FileName, "处理错误，编码失败：", err)
-		return
+		return nil
 	}
-	fileLists[info.FileName] = &info //将文件加入文件列表当中
 	//写文件
-	//将文件信息编码进一个二进制文件当中，客户端发起下载请求，服务器将文件发送给各个客户端。客户端对二进制文件进行反序列化，获得该文件的分片信息。再向服务器进行询问
+	//将文件信息编码进.god文件当中（格式见god包），客户端发起下载请求，服务器将文件发送给各个客户端。客户端对文件进行解析，获得该文件的分片信息。再向服务器进行询问
 	//服务器记录客户端的IP地址，将文件分片进行发送（客户端发送片段请求，服务器发送片段，客户端组合片段），并将客户端的IP地址记录在文件信息中
-	file, err := os.Create("./fileInfo/" + info.FileName + ".god")
+	err = god.WriteFile(godPath(info.FileName), &info.Meta)
 	if err != nil {
-		log.Println(info.FileName, "处理错误，创建文件失败：", err)
-		return
+		log.Println(info.FileName, "处理错误，写入元数据失败：", err)
+		return nil
 	}
-	defer file.Close()
-	_, err = file.Write(buf.Bytes())
+	tracker.PutFile(&info) //将文件加入文件列表当中
+	return &info
+}
+
+// 读取已有的.god文件。文件大小、修改时间和分片参数都对得上时，将分片信息填入info并返回true
+func loadCachedInfo(info *FileInfo) bool {
+	meta, err := god.ReadFile(godPath(info.FileName))
 	if err != nil {
-		log.Fatal("处理错误，写入文件失败：", err)
-		return
+		return false //没有或者读不了，重新分片就是
+	}
+	if meta.Version != god.Version || meta.HashAlgo != info.HashAlgo || meta.PieceSize != info.PieceSize ||
+		meta.FileName != info.FileName || meta.FileSize != info.FileSize || meta.ModTime != info.ModTime ||
+		!sameEntries(meta.Files, info.Files) {
+		return false
+	}
+	info.Meta = *meta
+	return true
+}
+
+// 遍历分享目录，按路径顺序记录每个文件的大小和偏移量。
+// 目录的修改时间取其中最新的文件，增删文件则通过文件表的变化发现
+func scanDir(info *FileInfo) error {
+	root := filePath(info.FileName)
+	info.Files = nil
+	info.FileSize = 0
+	info.ModTime = 0
+	return filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.Type().IsRegular() {
+			return nil //跳过目录本身和符号链接等特殊文件
+		}
+		stat, err := d.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, name)
+		if err != nil {
+			return err
+		}
+		info.Files = append(info.Files, &god.Entry{
+			Path:   filepath.ToSlash(rel),
+			Size:   int(stat.Size()),
+			Offset: info.FileSize,
+		})
+		info.FileSize += int(stat.Size())
+		if t := stat.ModTime().UnixNano(); t > info.ModTime {
+			info.ModTime = t
+		}
+		return nil
+	})
+}
+
+// 比较两个文件表是否相同
+func sameEntries(a, b []*god.Entry) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if *a[i] != *b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// 确定文件的分片大小。配置文件指定了piece_size就用指定的，否则从最小值开始翻倍，
+// 直到分片数不超过targetPieces。大文件的分片表不至于太大，小文件也不会拆出一堆小请求
+func choosePieceSize(fileSize int) int {
+	if config.Cfg.PieceSize > 0 {
+		return config.Cfg.PieceSize
 	}
+	size := minPieceSize
+	for size < maxPieceSize && chunkFileNum(fileSize, size) > targetPieces {
+		size *= 2
+	}
+	return size
 }
 
 // 确定文件分片的数目
@@ -100,40 +220,59 @@ func chunkFileNum(fileSize int, pieceSize int) int {
 
 // 进行分片操作
 func chunkFile(file *FileInfo, pieceSize int) error {
-	file.FilePieces = make([]*Piece, file.FilePiecesNum)
-	f, err := os.Open("./file/" + file.FileName) //加载文件的具体数据
+	file.FilePieces = make([]*god.Piece, file.FilePiecesNum)
+	f, err := god.Open(filePath(file.FileName), &file.Meta) //读取分片时才打开其中的文件，并发数受hashSem限制
 	if err != nil {
 		log.Println(file.FileName, "分片错误，加载文件失败：", err)
 		return err
 	}
 
 	defer f.Close()
-	for i := 0; i < file.FilePiecesNum; i++ {
-		var p Piece
-
-		p.PieceIndex = i
-		p.PieceStart = i * pieceSize //记录分片处在文件的起始位置
 
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+		failed   atomic.Bool
+	)
+	for i := 0; i < file.FilePiecesNum && !failed.Load(); i++ {
+		p := &god.Piece{
+			PieceIndex: i,
+			PieceStart: i * pieceSize, //记录分片处在文件的起始位置
+			PieceSize:  pieceSize,
+		}
 		if i == file.FilePiecesNum-1 {
 			p.PieceSize = file.FileSize - i*pieceSize
-		} else {
-			p.PieceSize = pieceSize
 		}
+		file.FilePieces[i] = p
 
-		pieceData := make([]byte, p.PieceSize)
-		_, err := f.ReadAt(pieceData, int64(p.PieceStart))
-		if err != nil {
-			log.Println(file.FileName, "处理错误，文件分片失败：", err)
-			return err
-		}
-		p.PieceHash = hash(pieceData)
-		file.FilePieces[i] = &p
-		file.filePiecesByStart[p.PieceStart] = &p
+		hashSem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-hashSem }()
+			bp := getBuffer(p.PieceSize)
+			defer putBuffer(bp)
+			_, err := f.ReadAt(*bp, int64(p.PieceStart))
+			if err != nil {
+				failed.Store(true)
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+			p.PieceHash = file.HashAlgo.Sum(*bp)
+			hashedBytes.Add(int64(p.PieceSize))
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		log.Println(file.FileName, "处理错误，文件分片失败：", firstErr)
+		return firstErr
+	}
+	//计算默克尔根，作为文件的身份标识
+	file.MerkleRoot, err = file.Root()
+	if err != nil {
+		log.Println(file.FileName, "处理错误，计算默克尔根失败：", err)
+		return err
 	}
 	return nil
 }
-
-// 计算哈希值
-func hash(data []byte) uint32 {
-	return crc32.ChecksumIEEE(data)
-}
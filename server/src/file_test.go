@@ -0,0 +1,245 @@
+package src
+
+import (
+	"Gdown/god"
+	"Gdown/server/src/config"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 把分享目录和元数据目录换成临时目录，追踪器换成新的内存存储
+func setupShare(t *testing.T) {
+	t.Helper()
+	old, oldTracker := config.Cfg, tracker
+	t.Cleanup(func() {
+		config.Cfg, tracker = old, oldTracker
+	})
+	config.Cfg.FileDir = t.TempDir()
+	config.Cfg.FileInfoDir = t.TempDir()
+	config.Cfg.PieceSize = 0
+	config.Cfg.Rehash = false
+	tracker = NewTracker(NewMemoryStore())
+}
+
+// 在分享目录下写一个文件
+func writeShare(t *testing.T, name string, data []byte) {
+	t.Helper()
+	path := filepath.Join(config.Cfg.FileDir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReloadFile(t *testing.T) {
+	setupShare(t)
+	writeShare(t, "dir/a.txt", []byte("hello"))
+	if name := shareName(filepath.Join(config.Cfg.FileDir, "dir", "a.txt")); name != "dir" {
+		t.Fatalf("分享名应为dir，实际%q", name)
+	}
+	if name := shareName(config.Cfg.FileDir); name != "" {
+		t.Fatalf("分享目录本身不属于任何分享，实际%q", name)
+	}
+
+	//新增的文件开始做种
+	reloadFile("dir")
+	info, ok := tracker.File("dir")
+	if !ok || info.FileSize != 5 {
+		t.Fatalf("新增的目录没有做种：%v %+v", ok, info)
+	}
+	if _, err := os.Stat(godPath("dir")); err != nil {
+		t.Fatal("没有写入元数据文件：", err)
+	}
+
+	//目录清空之后重新分片失败，旧的元数据不能继续用
+	if err := os.Remove(filepath.Join(config.Cfg.FileDir, "dir", "a.txt")); err != nil {
+		t.Fatal(err)
+	}
+	reloadFile("dir")
+	if _, ok = tracker.File("dir"); ok {
+		t.Fatal("清空的目录仍在做种")
+	}
+	writeShare(t, "dir/a.txt", []byte("hello"))
+	reloadFile("dir")
+	if _, ok = tracker.File("dir"); !ok {
+		t.Fatal("目录恢复之后没有重新做种")
+	}
+
+	//删除之后停止做种，元数据文件也删掉
+	if err := os.RemoveAll(filepath.Join(config.Cfg.FileDir, "dir")); err != nil {
+		t.Fatal(err)
+	}
+	reloadFile("dir")
+	if _, ok = tracker.File("dir"); ok {
+		t.Fatal("删除的目录仍在做种")
+	}
+	if _, err := os.Stat(godPath("dir")); !os.IsNotExist(err) {
+		t.Fatal("元数据文件没有删除：", err)
+	}
+}
+
+func TestReloadFileConcurrent(t *testing.T) {
+	setupShare(t)
+	config.Cfg.Rehash = true //每次都重新分片、写元数据文件
+	writeShare(t, "a.bin", bytes.Repeat([]byte("x"), 1<<20))
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reloadFile("a.bin")
+		}()
+	}
+	wg.Wait()
+	if _, ok := tracker.File("a.bin"); !ok {
+		t.Fatal("文件没有做种")
+	}
+	if _, err := god.ReadFile(godPath("a.bin")); err != nil {
+		t.Fatal("元数据文件损坏：", err)
+	}
+	entries, err := os.ReadDir(config.Cfg.FileInfoDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("元数据目录中应该只有一个文件，实际%d个，临时文件没有清理", len(entries))
+	}
+	reloading.Lock()
+	defer reloading.Unlock()
+	if len(reloading.names) != 0 {
+		t.Errorf("加载完成后还有%d把锁没有释放", len(reloading.names))
+	}
+}
+
+func TestLoadCachedInfo(t *testing.T) {
+	setupShare(t)
+	writeShare(t, "a.bin", bytes.Repeat([]byte("x"), 1000))
+	entry := func() os.DirEntry {
+		stat, err := os.Stat(filePath("a.bin"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return fs.FileInfoToDirEntry(stat)
+	}
+	first := handelFile(entry())
+	if first == nil {
+		t.Fatal("做种失败")
+	}
+
+	//文件没有变化时直接用缓存
+	info := FileInfo{}
+	info.FileName, info.HashAlgo, info.FileSize, info.ModTime, info.PieceSize = "a.bin", hashAlgo, first.FileSize, first.ModTime, first.PieceSize
+	if !loadCachedInfo(&info) || info.ID() != first.ID() {
+		t.Fatal("文件没有变化，应该使用缓存的元数据")
+	}
+
+	//大小、修改时间、分片大小任何一项对不上都要重新分片
+	for name, change := range map[string]func(*FileInfo){
+		"size":       func(i *FileInfo) { i.FileSize++ },
+		"mod_time":   func(i *FileInfo) { i.ModTime++ },
+		"piece_size": func(i *FileInfo) { i.PieceSize *= 2 },
+		"hash":       func(i *FileInfo) { i.HashAlgo = god.HashCRC32 },
+	} {
+		stale := FileInfo{}
+		stale.FileName, stale.HashAlgo, stale.FileSize, stale.ModTime, stale.PieceSize = "a.bin", hashAlgo, first.FileSize, first.ModTime, first.PieceSize
+		change(&stale)
+		if loadCachedInfo(&stale) {
+			t.Fatalf("%s变化后不应该使用缓存", name)
+		}
+	}
+
+	//文件内容变了，修改时间随之变化，重新做种得到新的默克尔根
+	writeShare(t, "a.bin", bytes.Repeat([]byte("y"), 1000))
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filePath("a.bin"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	second := handelFile(entry())
+	if second == nil || second.ID() == first.ID() {
+		t.Fatal("文件修改后应该重新分片")
+	}
+}
+
+func TestChunkFileParallel(t *testing.T) {
+	setupShare(t)
+	config.Cfg.PieceSize = 16 * 1024
+	rnd := rand.New(rand.NewSource(1))
+	contents := make(map[string][]byte)
+	for i := 0; i < 8; i++ {
+		data := make([]byte, 100*1024+rnd.Intn(50*1024)) //最后一片不满
+		rnd.Read(data)
+		name := fmt.Sprintf("f%d.bin", i)
+		writeShare(t, name, data)
+		contents[name] = data
+	}
+	//目录分享的分片跨越多个文件
+	a, b := make([]byte, 20*1024), make([]byte, 30*1024)
+	rnd.Read(a)
+	rnd.Read(b)
+	writeShare(t, "dir/a", a)
+	writeShare(t, "dir/b", b)
+	contents["dir"] = append(append([]byte(nil), a...), b...)
+
+	LoadFile() //多个文件、多个分片同时计算
+	for name, data := range contents {
+		info, ok := tracker.File(name)
+		if !ok {
+			t.Fatalf("%s没有做种", name)
+		}
+		size := config.Cfg.PieceSize
+		if info.FilePiecesNum != (len(data)+size-1)/size {
+			t.Fatalf("%s分片数错误：%d", name, info.FilePiecesNum)
+		}
+		hashes := make([]string, 0, info.FilePiecesNum)
+		for start := 0; start < len(data); start += size { //逐片串行计算，结果应该完全一致
+			end := start + size
+			if end > len(data) {
+				end = len(data)
+			}
+			hashes = append(hashes, hashAlgo.Sum(data[start:end]))
+		}
+		for i, p := range info.FilePieces {
+			if p.PieceHash != hashes[i] || p.PieceStart != i*size {
+				t.Fatalf("%s第%d片与串行计算的结果不一致", name, i)
+			}
+		}
+		root, _ := god.MerkleRoot(hashes)
+		if info.ID() != root {
+			t.Fatalf("%s默克尔根不一致", name)
+		}
+	}
+}
+
+func TestChoosePieceSize(t *testing.T) {
+	setupShare(t)
+	tests := []struct {
+		fileSize, want int
+	}{
+		{0, minPieceSize},
+		{1, minPieceSize},
+		{minPieceSize * targetPieces, minPieceSize},       //正好targetPieces片
+		{minPieceSize*targetPieces + 1, minPieceSize * 2}, //多出一点就加倍
+		{minPieceSize * 2 * targetPieces, minPieceSize * 2},
+		{maxPieceSize * targetPieces, maxPieceSize},
+		{maxPieceSize*targetPieces*4 + 1, maxPieceSize}, //超大文件不超过上限
+	}
+	for _, tt := range tests {
+		if got := choosePieceSize(tt.fileSize); got != tt.want {
+			t.Errorf("choosePieceSize(%d) = %d，期望%d", tt.fileSize, got, tt.want)
+		}
+	}
+
+	config.Cfg.PieceSize = 64 * 1024 //手动指定时总是用指定的大小
+	if got := choosePieceSize(maxPieceSize * targetPieces); got != 64*1024 {
+		t.Errorf("指定分片大小时应该返回%d，实际%d", 64*1024, got)
+	}
+}
@@ -0,0 +1,109 @@
+package src
+
+//文件句柄缓存。发送分片时不用每次都重新打开文件。
+//发送时需要Seek之后再交给sendfile，同一个句柄不能被两个请求同时使用，所以每个请求独占一个句柄，用完放回。
+
+import (
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	maxIdlePerFile = 8   //每个文件最多缓存的空闲句柄数
+	maxIdleTotal   = 256 //最多缓存的空闲句柄总数，目录分享文件很多，防止句柄耗尽
+)
+
+// 缓存中的文件句柄
+type cachedFile struct {
+	*os.File
+	path   string
+	gen    uint64 //取出时这个文件的代数，文件变动后旧句柄不再放回
+	broken bool   //读写出错的句柄不再复用
+}
+
+// 某个文件的句柄状态，既没有空闲句柄也没有正在使用的句柄时删除
+type handleEntry struct {
+	idle  []*cachedFile
+	inUse int    //正在使用的句柄数
+	gen   uint64 //文件每次变动加1，只影响这个文件的句柄
+}
+
+type handleCache struct {
+	mu    sync.Mutex
+	files map[string]*handleEntry
+	total int
+}
+
+var handles = &handleCache{files: make(map[string]*handleEntry)}
+
+// 取出一个句柄，没有空闲的就打开一个新的
+func (h *handleCache) get(path string) (*cachedFile, error) {
+	h.mu.Lock()
+	e := h.files[path]
+	if e == nil {
+		e = &handleEntry{}
+		h.files[path] = e
+	}
+	e.inUse++
+	if len(e.idle) > 0 {
+		f := e.idle[len(e.idle)-1]
+		e.idle = e.idle[:len(e.idle)-1]
+		h.total--
+		h.mu.Unlock()
+		return f, nil
+	}
+	gen := e.gen
+	h.mu.Unlock()
+
+	file, err := os.Open(path)
+	if err != nil {
+		h.mu.Lock()
+		e.inUse--
+		h.drop(path, e)
+		h.mu.Unlock()
+		return nil, err
+	}
+	return &cachedFile{File: file, path: path, gen: gen}, nil
+}
+
+// 放回句柄。缓存满了或者句柄已经过期时直接关闭
+func (h *handleCache) put(f *cachedFile) {
+	h.mu.Lock()
+	e := h.files[f.path] //句柄还没放回，这一项不会被删除
+	e.inUse--
+	if f.broken || f.gen != e.gen || h.total >= maxIdleTotal || len(e.idle) >= maxIdlePerFile {
+		h.drop(f.path, e)
+		h.mu.Unlock()
+		f.Close()
+		return
+	}
+	e.idle = append(e.idle, f)
+	h.total++
+	h.mu.Unlock()
+}
+
+// 关闭path及其下所有文件的空闲句柄，正在使用的句柄用完之后也不再放回。文件变动或删除时调用
+func (h *handleCache) evict(path string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for p, e := range h.files {
+		if p != path && !strings.HasPrefix(p, path+string(os.PathSeparator)) {
+			continue
+		}
+		for _, f := range e.idle {
+			f.Close()
+		}
+		h.total -= len(e.idle)
+		e.idle = nil
+		e.gen++
+		h.drop(p, e)
+	}
+}
+
+// 没有句柄了就删掉这一项。调用方需持有锁
+func (h *handleCache) drop(path string, e *handleEntry) {
+	if e.inUse == 0 && len(e.idle) == 0 {
+		delete(h.files, path)
+	}
+}
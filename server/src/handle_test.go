@@ -0,0 +1,42 @@
+package src
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 一个文件变动只让它自己的句柄失效，其他文件的缓存句柄不受影响
+func TestEvictPerPath(t *testing.T) {
+	dir := t.TempDir()
+	a, b := filepath.Join(dir, "a"), filepath.Join(dir, "b")
+	for _, p := range []string{a, b} {
+		if err := os.WriteFile(p, []byte(p), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	h := &handleCache{files: make(map[string]*handleEntry)}
+	fa, err := h.get(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fb, err := h.get(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.evict(a) //a正在使用的时候发生变动
+	h.put(fa)
+	h.put(fb)
+	if h.files[a] != nil {
+		t.Fatal("过期的句柄被放回了缓存")
+	}
+	if e := h.files[b]; e == nil || len(e.idle) != 1 || h.total != 1 {
+		t.Fatal("其他文件的句柄被一起作废了")
+	}
+
+	h.evict(dir) //目录下的所有文件
+	if len(h.files) != 0 || h.total != 0 {
+		t.Fatalf("evict之后还剩%d个空闲句柄", h.total)
+	}
+}
@@ -0,0 +1,52 @@
+package src
+
+//分片哈希的并发控制。所有文件的分片共用一个信号量，同时计算哈希的分片数不超过CPU核数，
+//读文件的缓冲区复用，避免每个分片都重新分配。
+
+import (
+	"log"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	hashSem    = make(chan struct{}, runtime.NumCPU()) //限制同时计算哈希的分片数
+	bufferPool = sync.Pool{
+		New: func() interface{} {
+			b := make([]byte, 0, minPieceSize)
+			return &b
+		},
+	}
+	hashedBytes atomic.Int64 //已经读取并计算哈希的字节数，用于显示进度
+)
+
+// 从缓冲池中取出一块大小为size的缓冲区
+func getBuffer(size int) *[]byte {
+	bp := bufferPool.Get().(*[]byte)
+	if cap(*bp) < size {
+		*bp = make([]byte, size)
+	}
+	*bp = (*bp)[:size]
+	return bp
+}
+
+// 放回缓冲区
+func putBuffer(bp *[]byte) {
+	bufferPool.Put(bp)
+}
+
+// 每隔一段时间打印做种进度，直到stop被关闭
+func logProgress(done *atomic.Int64, total int, stop chan struct{}) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			log.Printf("做种进度：%d/%d个文件，已计算%.1fMB", done.Load(), total, float64(hashedBytes.Load())/1024/1024)
+		case <-stop:
+			return
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package src
+
+//Prometheus监控指标，在metrics_addr上通过/metrics导出，不经过下载服务的端口。
+
+import (
+	"Gdown/server/src/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	piecesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gdown_pieces_served_total",
+		Help: "服务器完整发送的分片数",
+	})
+	bytesServed = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "gdown_bytes_served_total",
+		Help: "服务器发送的分片字节数",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "gdown_peers_connected",
+		Help: "在线的客户端数目",
+	}, func() float64 {
+		return float64(len(tracker.Online()))
+	}))
+	prometheus.MustRegister(swarmCollector{})
+}
+
+var (
+	swarmSeedersDesc = prometheus.NewDesc("gdown_swarm_seeders", "所有文件swarm中的客户端数目之和", nil, nil)
+	//文件名会暴露分享的内容，文件多时指标也会很多，只有metrics_file_label打开时才导出
+	fileSeedersDesc = prometheus.NewDesc("gdown_file_seeders", "每个文件swarm中的客户端数目", []string{"file"}, nil)
+)
+
+// 每次抓取时遍历文件列表，文件的增删不需要额外维护指标
+type swarmCollector struct{}
+
+func (swarmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- swarmSeedersDesc
+	ch <- fileSeedersDesc
+}
+
+func (swarmCollector) Collect(ch chan<- prometheus.Metric) {
+	total := 0
+	for _, info := range tracker.Files() {
+		n := tracker.SeederCount(info.FileName)
+		total += n
+		if config.Cfg.MetricsFileLabel {
+			ch <- prometheus.MustNewConstMetric(fileSeedersDesc, prometheus.GaugeValue, float64(n), info.FileName)
+		}
+	}
+	ch <- prometheus.MustNewConstMetric(swarmSeedersDesc, prometheus.GaugeValue, float64(total))
+}
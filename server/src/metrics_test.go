@@ -0,0 +1,30 @@
+package src
+
+import (
+	"Gdown/god"
+	"Gdown/server/src/config"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// 默认不按文件名导出，打开metrics_file_label之后每个文件一项
+func TestSwarmCollector(t *testing.T) {
+	setupShare(t)
+	for _, name := range []string{"a.zip", "b.zip"} {
+		tracker.PutFile(&FileInfo{Meta: god.Meta{FileName: name, FilePiecesNum: 1}})
+		if err := tracker.Complete(name, "p1"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := testutil.CollectAndCount(swarmCollector{}, "gdown_file_seeders"); n != 0 {
+		t.Fatalf("默认导出了%d个按文件名的指标", n)
+	}
+	if v := testutil.ToFloat64(swarmCollector{}); v != 2 {
+		t.Fatalf("gdown_swarm_seeders=%v，期望2", v)
+	}
+	config.Cfg.MetricsFileLabel = true
+	if n := testutil.CollectAndCount(swarmCollector{}, "gdown_file_seeders"); n != 2 {
+		t.Fatalf("打开之后导出了%d个按文件名的指标，期望2个", n)
+	}
+}
@@ -0,0 +1,196 @@
+package src
+
+//服务器上传限速。/down的发送速度受三层限制：全局、每个客户端、每个用户，单位都是字节每秒。
+//每层是一个按虚拟时间排队的令牌桶：每次发送一小块之前先在各层预约，预约按先来后到排在时间线上。
+//全局带宽在正在下载的客户端之间平分：每个客户端的速度不超过全局速率除以客户端数，
+//开了很多连接的客户端也只能拿到一份，不会挤占其它客户端。
+//同时传输的分片数超过上限时直接返回503和Retry-After，不让请求无限排队。
+//限速参数在创建限速器时确定，之后不再修改，读取时不需要加锁。
+
+import (
+	"Gdown/server/src/config"
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	throttleChunk = 32 * 1024              //限速时每次发送的字节数
+	burstWindow   = 200 * time.Millisecond //空闲之后允许突发的时长
+)
+
+// 令牌桶。速率由调用方传入，同一个桶可以按变化的速率预约
+type bucket struct {
+	mu   sync.Mutex
+	next time.Time //已经预约到的时间点
+}
+
+// 按rate字节每秒预约n字节，返回需要等待的时间。rate为0时不限速
+func (b *bucket) reserve(n, rate int) time.Duration {
+	if b == nil || rate <= 0 {
+		return 0
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if earliest := now.Add(-burstWindow); b.next.Before(earliest) {
+		b.next = earliest //空闲期间积累的额度最多只能用burstWindow
+	}
+	b.next = b.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	if wait := b.next.Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// 某个客户端或用户的限速状态，没有正在进行的传输时删除
+type limitEntry struct {
+	bucket *bucket
+	active int //正在进行的传输数
+}
+
+// 上传限速器
+type uploadLimiter struct {
+	rate, peerRate, userRate   int //全局、每个客户端、每个用户的速率上限
+	maxUploads, maxPeerUploads int //同时传输的分片数上限
+
+	mu     sync.Mutex
+	global *bucket
+	active int
+	peers  map[string]*limitEntry
+	users  map[string]*limitEntry
+}
+
+var uploads = newUploadLimiter(config.Config{})
+
+// 按配置创建限速器
+func newUploadLimiter(cfg config.Config) *uploadLimiter {
+	return &uploadLimiter{
+		rate:           cfg.UploadRate,
+		peerRate:       cfg.PeerUploadRate,
+		userRate:       cfg.UserUploadRate,
+		maxUploads:     cfg.MaxUploads,
+		maxPeerUploads: cfg.MaxPeerUploads,
+		global:         &bucket{},
+		peers:          make(map[string]*limitEntry),
+		users:          make(map[string]*limitEntry),
+	}
+}
+
+// 一次分片传输占用的额度
+type uploadSlot struct {
+	l          *uploadLimiter
+	peer, user string
+	peerBucket *bucket
+	userBucket *bucket //user为空时是nil
+}
+
+// 开始一次传输。超过同时传输的上限时返回false。user为空时不做用户级别的限制
+func (l *uploadLimiter) acquire(peer, user string) (*uploadSlot, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.maxUploads > 0 && l.active >= l.maxUploads {
+		return nil, false
+	}
+	if e := l.peers[peer]; l.maxPeerUploads > 0 && e != nil && e.active >= l.maxPeerUploads {
+		return nil, false
+	}
+
+	l.active++
+	slot := &uploadSlot{l: l, peer: peer, user: user, peerBucket: limitEnter(l.peers, peer)}
+	if user != "" {
+		slot.userBucket = limitEnter(l.users, user)
+	}
+	return slot, true
+}
+
+// 调用方需持有锁
+func limitEnter(m map[string]*limitEntry, key string) *bucket {
+	e := m[key]
+	if e == nil {
+		e = &limitEntry{bucket: &bucket{}}
+		m[key] = e
+	}
+	e.active++
+	return e.bucket
+}
+
+// 调用方需持有锁
+func limitLeave(m map[string]*limitEntry, key string) {
+	if e := m[key]; e != nil {
+		if e.active--; e.active <= 0 {
+			delete(m, key)
+		}
+	}
+}
+
+// 每个客户端当前的速率上限：peer_upload_rate和全局速率平分给正在下载的客户端之后的较小值
+func (l *uploadLimiter) peerShare() int {
+	if l.rate <= 0 {
+		return l.peerRate
+	}
+	l.mu.Lock()
+	n := len(l.peers)
+	l.mu.Unlock()
+	share := l.rate
+	if n > 1 {
+		share = l.rate / n
+	}
+	if l.peerRate > 0 && l.peerRate < share {
+		return l.peerRate
+	}
+	return share
+}
+
+// 传输结束，放回额度
+func (s *uploadSlot) release() {
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	s.l.active--
+	limitLeave(s.l.peers, s.peer)
+	if s.user != "" {
+		limitLeave(s.l.users, s.user)
+	}
+}
+
+// 是否需要限速。不限速时直接从文件拷贝，可以用上sendfile
+func (s *uploadSlot) throttled() bool {
+	return s.l.rate > 0 || s.l.peerRate > 0 || (s.userBucket != nil && s.l.userRate > 0)
+}
+
+// 按限速包装reader，每次最多读throttleChunk字节，读之前在各层令牌桶预约并等待
+func (s *uploadSlot) reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, slot: s}
+}
+
+type throttledReader struct {
+	r    io.Reader
+	slot *uploadSlot
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	s := t.slot
+	wait := s.l.global.reserve(len(p), s.l.rate)
+	if w := s.peerBucket.reserve(len(p), s.l.peerShare()); w > wait {
+		wait = w
+	}
+	if w := s.userBucket.reserve(len(p), s.l.userRate); w > wait {
+		wait = w
+	}
+	time.Sleep(wait)
+	return t.r.Read(p)
+}
+
+// 建议客户端多久之后重试：按全局速率发送一个分片的时间，至少1秒
+func (l *uploadLimiter) retryAfter(pieceSize int) int {
+	if l.rate <= 0 {
+		return 1
+	}
+	if s := (pieceSize + l.rate - 1) / l.rate; s > 1 {
+		return s
+	}
+	return 1
+}
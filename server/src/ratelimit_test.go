@@ -0,0 +1,146 @@
+package src
+
+import (
+	"Gdown/server/src/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBucketReserve(t *testing.T) {
+	var nilBucket *bucket
+	if w := nilBucket.reserve(1000, 10); w != 0 {
+		t.Fatalf("nil桶等待了%v", w)
+	}
+	b := &bucket{}
+	if w := b.reserve(1<<20, 0); w != 0 {
+		t.Fatalf("不限速时等待了%v", w)
+	}
+
+	//空闲之后最多突发burstWindow：1000字节每秒时前200字节不用等
+	if w := b.reserve(200, 1000); w != 0 {
+		t.Fatalf("突发额度内等待了%v", w)
+	}
+	//再预约300字节要等300毫秒
+	if w := b.reserve(300, 1000); w < 250*time.Millisecond || w > 300*time.Millisecond {
+		t.Fatalf("等待%v，期望约300ms", w)
+	}
+	//预约按先后排队，后来的排在后面
+	if w := b.reserve(100, 1000); w < 350*time.Millisecond || w > 400*time.Millisecond {
+		t.Fatalf("等待%v，期望约400ms", w)
+	}
+}
+
+func TestAcquireLimits(t *testing.T) {
+	l := newUploadLimiter(config.Config{MaxUploads: 3, MaxPeerUploads: 2})
+	a1, ok1 := l.acquire("a", "alice")
+	_, ok2 := l.acquire("a", "alice")
+	if !ok1 || !ok2 {
+		t.Fatal("上限之内获取失败")
+	}
+	if _, ok := l.acquire("a", "alice"); ok {
+		t.Fatal("超过每个客户端的上限")
+	}
+	b, ok := l.acquire("b", "")
+	if !ok {
+		t.Fatal("其它客户端不受a的上限影响")
+	}
+	if _, ok := l.acquire("c", ""); ok {
+		t.Fatal("超过全部的上限")
+	}
+	a1.release()
+	if _, ok := l.acquire("c", ""); !ok {
+		t.Fatal("放回之后仍然获取失败")
+	}
+	if b.userBucket != nil {
+		t.Fatal("没有用户的传输不应该有用户级别的限速")
+	}
+}
+
+func TestPeerShare(t *testing.T) {
+	l := newUploadLimiter(config.Config{UploadRate: 1000})
+	a, _ := l.acquire("a", "")
+	if r := l.peerShare(); r != 1000 {
+		t.Fatalf("只有一个客户端时速率%d，期望1000", r)
+	}
+	l.acquire("a", "") //同一个客户端开再多连接也只算一份
+	l.acquire("a", "")
+	l.acquire("b", "")
+	if r := l.peerShare(); r != 500 {
+		t.Fatalf("两个客户端时速率%d，期望500", r)
+	}
+	a.release()
+	if r := l.peerShare(); r != 500 {
+		t.Fatalf("a还有连接时速率%d，期望500", r)
+	}
+
+	l = newUploadLimiter(config.Config{UploadRate: 1000, PeerUploadRate: 300})
+	l.acquire("a", "")
+	if r := l.peerShare(); r != 300 {
+		t.Fatalf("peer_upload_rate更小时速率%d，期望300", r)
+	}
+	l = newUploadLimiter(config.Config{PeerUploadRate: 300})
+	if r := l.peerShare(); r != 300 {
+		t.Fatalf("不限全局时速率%d，期望300", r)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		rate, pieceSize, want int
+	}{
+		{0, 1 << 20, 1},
+		{1000, 500, 1},
+		{1000, 1000, 1},
+		{1000, 2500, 3},
+		{1 << 20, 4 << 20, 4},
+	}
+	for _, tt := range tests {
+		l := newUploadLimiter(config.Config{UploadRate: tt.rate})
+		if got := l.retryAfter(tt.pieceSize); got != tt.want {
+			t.Errorf("rate=%d pieceSize=%d：%d，期望%d", tt.rate, tt.pieceSize, got, tt.want)
+		}
+	}
+}
+
+// 同时传输的分片太多时/down返回503和Retry-After
+func TestSendFilePieceBusy(t *testing.T) {
+	setupShare(t)
+	old := uploads
+	t.Cleanup(func() { uploads = old })
+	writeShare(t, "a.bin", make([]byte, 3000))
+	reloadFile("a.bin")
+	if _, ok := tracker.File("a.bin"); !ok {
+		t.Fatal("文件没有做种")
+	}
+
+	request := func(peer string) *httptest.ResponseRecorder {
+		gin.SetMode(gin.TestMode)
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/down", strings.NewReader(`{"file_name":"a.bin"}`))
+		c.Request.Header.Set("Range", "bytes=0-99")
+		c.Set(ctxPeer, &client{ID: peer, User: peer})
+		sendFilePiece(c)
+		return w
+	}
+
+	uploads = newUploadLimiter(config.Config{UploadRate: 1000, MaxUploads: 2, MaxPeerUploads: 1})
+	uploads.acquire("a", "a")
+	if w := request("a"); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "3" {
+		t.Fatalf("超过每个客户端的上限：状态码%d，Retry-After=%q", w.Code, w.Header().Get("Retry-After"))
+	}
+	uploads.acquire("b", "b")
+	if w := request("c"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("超过全部的上限：状态码%d", w.Code)
+	}
+
+	uploads = newUploadLimiter(config.Config{})
+	if w := request("a"); w.Code != http.StatusPartialContent || w.Body.Len() != 100 {
+		t.Fatalf("不限速时：状态码%d，长度%d", w.Code, w.Body.Len())
+	}
+}
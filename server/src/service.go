@@ -1,22 +1,35 @@
 package src
 
 import (
+	"Gdown/protocol"
+	"Gdown/server/src/config"
 	"Gdown/server/src/user"
+	"context"
+	"errors"
 	"log"
+	"net"
 	"net/http"
-	"time"
+	"os"
+	"os/signal"
+	"strconv"
+	"sync"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// 在线的客户端。客户端拥有哪些文件由追踪器记录，客户端下线的时候从每个文件的swarm里把它删掉。
 type client struct {
-	IPAdr        string               //记录客户端的IP地址
-	DownFileList map[string]*FileInfo //维护客户端下载的文件列表。客户端下线的时候，从每个文件列表里把它删掉。
+	ID      string          //客户端标识，由客户端生成，通过X-Peer-ID请求头传递
+	User    string          //客户端登录的用户
+	IPAdr   string          //客户端公布的地址，IP:端口
+	conn    *websocket.Conn //与客户端的websocket连接
+	out     chan []byte     //发送队列，由writeLoop写入连接
+	writeMu sync.Mutex      //websocket不支持并发写，writeLoop和发送关闭帧共用一个连接
 }
 
-var clientList = make(map[string]*client) //维护客户端列表。
-
 var upgrade = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
@@ -28,32 +41,98 @@ var upgrade = websocket.Upgrader{
 //服务器与客户端建立联系，提供下载
 //使用gin框架建立连接，再采用gorilla/websocket进行长链接。使用心跳检测检测各个客户端是否在线。
 
-// InitRouter 初始化路由
+// InitRouter 初始化路由并开始服务，阻塞到收到SIGINT或SIGTERM。
+// 退出时不再接受新的请求，等待正在发送的分片完成（最多shutdown_timeout），再关闭所有websocket和追踪器的存储
 func InitRouter() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	uploads = newUploadLimiter(config.Cfg) //限速参数只在启动时读取
+	srv := &http.Server{
+		Addr:    ":" + strconv.Itoa(config.Cfg.Port),
+		Handler: newRouter(),
+	}
+	errChan := make(chan error, 2)
+	go func() {
+		errChan <- srv.ListenAndServe()
+	}()
+	//监控指标单独监听，默认只对本机开放，不和下载服务共用端口
+	var metricsSrv *http.Server
+	if config.Cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", promhttp.Handler())
+		metricsSrv = &http.Server{Addr: config.Cfg.MetricsAddr, Handler: mux}
+		go func() {
+			errChan <- metricsSrv.ListenAndServe()
+		}()
+	}
+	select {
+	case err := <-errChan:
+		log.Fatalf("启动服务失败:%v", err)
+	case <-ctx.Done():
+	}
+	stop() //再按一次Ctrl+C直接退出
+	log.Println("正在关闭服务器")
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.Cfg.ShutdownTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		log.Println("等待请求完成超时：", err)
+	}
+	if metricsSrv != nil {
+		metricsSrv.Close()
+	}
+	tracker.Close()
+	log.Println("服务器已关闭")
+}
+
+func newRouter() *gin.Engine {
 	r := gin.Default()
+	//默认谁的X-Forwarded-For都不信，ClientIP就是连接的对端地址。封禁、客户端和IP的绑定、凭证都依赖它
+	if err := r.SetTrustedProxies(config.Cfg.TrustedProxies); err != nil {
+		log.Println("设置信任的代理失败：", err)
+	}
 	u := r.Group("/user")
 	{
 		u.GET("/login", user.Login)
 		u.POST("/register", user.Register)
+		u.POST("/refresh", user.Refresh) //用refresh token换新的token
+		u.POST("/logout", user.Logout)   //退出登录，注销token
+	}
+	r.GET("/", auth, connect)        //客户端与服务器建立连接。
+	d := r.Group("", auth, peerAuth) //数据接口，只有已经建立连接的客户端能用
+	{
+		d.POST("/list", getFileList)  //客户端向服务器发送已经下载的文件的列表
+		d.GET("/meta", sendMetaDate)  //客户端下载文件，服务器返回此文件的元数据和拥有此文件的客户端的IP地址
+		d.GET("/down", sendFilePiece) //下载具体的分片
+		d.GET("/files", listFiles)    //查询服务器上的文件列表
+		d.GET("/ticket", sendTicket)  //换新的p2p访问凭证
+	}
+	a := r.Group("/admin", auth, adminAuth)
+	{
+		a.GET("/peers", adminPeers)                     //在线客户端
+		a.DELETE("/peers/:id", adminKick)               //断开客户端
+		a.GET("/bans", adminBans)                       //封禁列表
+		a.POST("/bans", adminBan)                       //封禁用户或IP
+		a.DELETE("/bans/:kind/:value", adminUnban)      //解除封禁
+		a.DELETE("/swarms/:file", adminRemoveSwarm)     //清空文件的swarm
+		a.DELETE("/swarms/:file/:id", adminRemoveSwarm) //把客户端移出文件的swarm
 	}
-	r.GET("/", connect)           //客户端与服务器建立连接。
-	r.POST("/list", getFileList)  //客户端向服务器发送已经下载的文件的列表
-	r.GET("/meta", sendMetaDate)  //客户端下载文件，服务器返回此文件的元数据和拥有此文件的客户端的IP地址
-	r.GET("/down", sendFilePiece) //下载具体的分片
-	r.Run()
+	return r
 }
 
-func getFileList(c *gin.Context) {
-	port := c.GetHeader("X-User-Port")
-	ip := c.ClientIP() + ":" + port
-
-	client, ok := clientList[ip]
-	if !ok {
-		c.JSON(http.StatusForbidden, gin.H{
-			"message": "客户端未建立连接",
-		})
-		return
+// 客户端的IP
+func (cli *client) host() string {
+	host, _, err := net.SplitHostPort(cli.IPAdr)
+	if err != nil {
+		return cli.IPAdr
 	}
+	return host
+}
+
+// 客户端向服务器发送已经下载的文件列表。新的客户端通过websocket的hello消息发送，这个接口为兼容旧客户端保留
+func getFileList(c *gin.Context) {
+	cli := requestPeer(c)
 	type fileList struct {
 		FileName []string `json:"file_name"`
 	}
@@ -67,11 +146,17 @@ func getFileList(c *gin.Context) {
 		return
 	}
 	for _, fileName := range fl.FileName {
-		if _, ok := fileLists[fileName]; !ok { //健壮性检查
+		if _, ok := tracker.File(fileName); !ok { //健壮性检查
 			continue
 		}
-		fileLists[fileName].ipAdr.Store(ip, true)           //将客户端ip追加到文件的列表当中去
-		client.DownFileList[fileName] = fileLists[fileName] //将此文件加入到客户端的下载文件列表当中去
+		err = tracker.Complete(fileName, cli.ID) //将客户端追加到文件的swarm当中去
+		if err != nil && !errors.Is(err, ErrExcluded) {
+			c.JSON(http.StatusInternalServerError, gin.H{
+				"message": "服务器内部错误",
+			})
+			log.Println("更新客户端列表失败：", err)
+			return
+		}
 	}
 
 	c.JSON(http.StatusOK, gin.H{
@@ -82,103 +167,61 @@ func getFileList(c *gin.Context) {
 
 // websocket连接的处理函数,用于检测客户端是否下线
 // connect 客户端与服务器建立websocket长连接
-// 进行客户端鉴权
+// 客户端鉴权由auth完成
 func connect(c *gin.Context) {
-	//验证token
-	token := c.GetHeader("Authorization")
-	if token == "" {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"message": "未授权",
+	username := requestUser(c).Username
+	//检查客户端标识，标识和用户绑定，不能冒用其它用户的标识
+	peerID := c.GetHeader("X-Peer-ID")
+	if !protocol.ValidPeerID(peerID) {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "缺少客户端标识或格式错误",
 		})
 		return
 	}
-	claims, err := user.ParseToken(token)
-	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"message": "未授权",
+	//客户端p2p服务的端口，其它客户端按这个端口来取分片
+	port, err := strconv.Atoi(c.GetHeader("X-User-Port"))
+	if err != nil || port < 1 || port > 65535 {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "缺少客户端端口或格式错误",
 		})
 		return
 	}
-	if !claims {
-		c.JSON(http.StatusUnauthorized, gin.H{
-			"message": "未授权",
+	err = tracker.CheckOwner(peerID, username)
+	if errors.Is(err, ErrPeerOwned) {
+		c.JSON(http.StatusForbidden, gin.H{
+			"message": err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.Println("查询客户端失败：", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "服务器内部错误",
 		})
 		return
 	}
 
-	var cli client
-	cli.IPAdr = c.ClientIP() + ":" + c.GetHeader("X-User-Port")
-	clientList[cli.IPAdr] = &cli                                    //将客户端加入到客户端列表当中去
-	clientList[cli.IPAdr].DownFileList = make(map[string]*FileInfo) //初始化客户端的下载文件列表
-
-	//升级为websocket协议，维护心跳
+	//升级为websocket协议，之后的通信走websocket上的控制消息
 	conn, err := upgrade.Upgrade(c.Writer, c.Request, nil)
 	if err != nil {
 		log.Println("与客户端建立连接失败，websocket升级错误：", err)
 		return
 	}
-	heartBeat(conn) //心跳和断线检测，并不需要并发读写操作，直接阻塞就行了
-	//当心跳断开的时候
-	deleteFileIP(&cli)
-	delete(clientList, cli.IPAdr) //从客户端列表里删掉这个客户端
-}
 
-// 心跳和断线检测
-func heartBeat(conn *websocket.Conn) {
-	var ticker = time.NewTicker(60 * time.Second)
-	defer ticker.Stop()
-	defer conn.Close()
-	var stopChan = make(chan bool) //用于停止进程
-
-	//发送心跳
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				err := conn.WriteMessage(websocket.TextMessage, []byte("ping!"))
-				if err != nil {
-					if err.Error() == "websocket: close sent" {
-						return
-					}
-					log.Println("发送心跳失败：", err)
-					stopChan <- true
-					return
-				}
-			}
-		}
-	}()
-
-	//检测客户端断线
-	go func() {
-		for {
-			err := conn.SetReadDeadline(time.Now().Add(125 * time.Second)) //重置读取截止时间
-			if err != nil {
-				log.Println("设置读取截止时间失败：", err)
-				stopChan <- true
-				return
-			}
-			_, _, err = conn.ReadMessage()
-			if err != nil {
-				log.Println("客户端断线：", err)
-				stopChan <- true
-				return
-			}
-		}
-	}()
-
-	//停止进程
-	for {
-		select {
-		case <-stopChan:
-			return
-		}
+	var cli client
+	cli.IPAdr = net.JoinHostPort(c.ClientIP(), strconv.Itoa(port))
+	cli.ID = peerID
+	cli.User = username
+	cli.conn = conn
+	cli.out = make(chan []byte, sendQueueSize)
+	err = tracker.Connect(&cli) //将客户端加入到追踪器当中去
+	if err != nil {
+		log.Println("记录客户端失败：", err)
+		conn.Close()
+		return
 	}
-}
 
-// 当客户端断线的时候，删除文件信息里客户端的ip地址
-func deleteFileIP(cli *client) {
-	for i := range cli.DownFileList {
-		file := cli.DownFileList[i]
-		file.ipAdr.Delete(cli.IPAdr)
-	}
+	serve(&cli) //处理客户端的消息和心跳，直接阻塞就行了
+	//当连接断开的时候，从追踪器里删掉这个客户端
+	tracker.Disconnect(&cli)
 }
@@ -0,0 +1,38 @@
+package src
+
+import (
+	"Gdown/server/src/config"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// 伪造的X-Forwarded-For不能改变客户端的IP，否则封禁、客户端和IP的绑定、凭证都能绕过
+func TestClientIPIgnoresForgedHeader(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	old := config.Cfg
+	t.Cleanup(func() { config.Cfg = old })
+
+	clientIP := func() string {
+		r := newRouter()
+		r.GET("/test-ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+		req := httptest.NewRequest(http.MethodGet, "/test-ip", nil)
+		req.RemoteAddr = "192.0.2.1:5000"
+		req.Header.Set("X-Forwarded-For", "10.0.0.1")
+		req.Header.Set("X-Real-IP", "10.0.0.1")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w.Body.String()
+	}
+
+	config.Cfg.TrustedProxies = nil
+	if ip := clientIP(); ip != "192.0.2.1" {
+		t.Errorf("没有配置代理时ClientIP为%s，期望连接的对端地址192.0.2.1", ip)
+	}
+	config.Cfg.TrustedProxies = []string{"192.0.2.0/24"}
+	if ip := clientIP(); ip != "10.0.0.1" {
+		t.Errorf("来自信任的代理时ClientIP为%s，期望X-Forwarded-For中的10.0.0.1", ip)
+	}
+}
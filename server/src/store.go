@@ -0,0 +1,264 @@
+package src
+
+//追踪器的存储后端。保存客户端信息，以及每个文件有哪些客户端（swarm）和各自拥有哪些分片。
+//默认使用内存存储，服务器重启后需要持久化时使用bbolt存储（boltstore.go），其它后端实现Store接口即可接入。
+
+import (
+	"Gdown/protocol"
+	"sync"
+	"time"
+)
+
+// Peer 追踪器记录的客户端信息。客户端下线后仍然保留，标识与用户的对应关系不会因为断线而丢失
+type Peer struct {
+	ID          string    `json:"id"`           //客户端标识，由客户端生成并持久保存
+	User        string    `json:"user"`         //客户端所属的用户，标识只能由这个用户使用
+	Addrs       []string  `json:"addrs"`        //客户端公布的地址，最近使用的在前面
+	ConnectedAt time.Time `json:"connected_at"` //最近一次建立连接的时间
+	LastSeen    time.Time `json:"last_seen"`    //最近一次在线的时间，离线超过peer_ttl的客户端会被清理
+}
+
+const maxPeerAddrs = 4 //每个客户端最多记录的地址数
+
+// Addr 其它客户端连接它使用的地址，即最近一次公布的地址
+func (p Peer) Addr() string {
+	if len(p.Addrs) == 0 {
+		return ""
+	}
+	return p.Addrs[0]
+}
+
+// 记录新公布的地址，放到最前面
+func (p *Peer) addAddr(addr string) {
+	addrs := []string{addr}
+	for _, a := range p.Addrs {
+		if a != addr && len(addrs) < maxPeerAddrs {
+			addrs = append(addrs, a)
+		}
+	}
+	p.Addrs = addrs
+}
+
+// Ban 封禁记录
+type Ban struct {
+	Kind      string    `json:"kind"`       //封禁类型，user或addr
+	Value     string    `json:"value"`      //用户名或IP
+	Reason    string    `json:"reason"`     //封禁原因
+	By        string    `json:"by"`         //执行封禁的管理员
+	CreatedAt time.Time `json:"created_at"` //封禁时间
+}
+
+// 封禁类型
+const (
+	BanUser = "user"
+	BanAddr = "addr"
+)
+
+// Store 追踪器的存储后端，实现必须是并发安全的
+type Store interface {
+	PutPeer(p Peer) error                                              //添加或更新客户端
+	GetPeer(id string) (Peer, bool, error)                             //获取客户端
+	DeletePeer(id string) error                                        //删除客户端，同时退出它加入的所有swarm
+	LeaveAll(id string) error                                          //客户端退出它加入的所有swarm，客户端记录保留
+	Peers() ([]Peer, error)                                            //所有客户端
+	Join(fileName, id string) error                                    //客户端加入文件的swarm，已经在swarm中时不改变分片记录
+	SetPieces(fileName, id string, bf protocol.Bitfield) error         //记录客户端拥有的分片，不在swarm中时加入
+	Pieces(fileName, id string) (protocol.Bitfield, bool, error)       //客户端拥有的分片
+	SwarmPieces(fileName string) (map[string]protocol.Bitfield, error) //文件swarm中每个客户端拥有的分片
+	Leave(fileName, id string) error                                   //客户端退出文件的swarm
+	Members(fileName string) ([]string, error)                         //文件swarm中的所有客户端
+	PeerFiles(id string) ([]string, error)                             //客户端加入的所有swarm
+	DropSwarm(fileName string) ([]string, error)                       //清空文件的swarm，返回原来的成员
+	PutBan(b Ban) error                                                //添加或更新封禁
+	DeleteBan(kind, value string) (bool, error)                        //解除封禁，返回是否存在
+	Bans() ([]Ban, error)                                              //所有封禁
+	Close() error                                                      //关闭存储
+}
+
+// 内存存储
+type memoryStore struct {
+	mu     sync.RWMutex
+	peers  map[string]Peer
+	swarms map[string]map[string]protocol.Bitfield //文件名 -> 客户端 -> 拥有的分片
+	joined map[string]map[string]struct{}          //客户端 -> 文件名，客户端下线时用
+	bans   map[string]Ban                          //类型:值 -> 封禁
+}
+
+// NewMemoryStore 创建内存存储，服务器重启后数据丢失
+func NewMemoryStore() Store {
+	return &memoryStore{
+		peers:  make(map[string]Peer),
+		swarms: make(map[string]map[string]protocol.Bitfield),
+		joined: make(map[string]map[string]struct{}),
+		bans:   make(map[string]Ban),
+	}
+}
+
+func (s *memoryStore) PutPeer(p Peer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.peers[p.ID] = p
+	return nil
+}
+
+func (s *memoryStore) GetPeer(id string) (Peer, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.peers[id]
+	return p, ok, nil
+}
+
+func (s *memoryStore) DeletePeer(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leaveAll(id)
+	delete(s.peers, id)
+	return nil
+}
+
+func (s *memoryStore) LeaveAll(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leaveAll(id)
+	return nil
+}
+
+// 调用方需持有写锁
+func (s *memoryStore) leaveAll(id string) {
+	for fileName := range s.joined[id] {
+		s.leave(fileName, id)
+	}
+	delete(s.joined, id)
+}
+
+func (s *memoryStore) Peers() ([]Peer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	peers := make([]Peer, 0, len(s.peers))
+	for _, p := range s.peers {
+		peers = append(peers, p)
+	}
+	return peers, nil
+}
+
+func (s *memoryStore) Join(fileName, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.swarms[fileName][id]; !ok {
+		s.join(fileName, id, nil)
+	}
+	return nil
+}
+
+func (s *memoryStore) SetPieces(fileName, id string, bf protocol.Bitfield) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.join(fileName, id, append(protocol.Bitfield(nil), bf...))
+	return nil
+}
+
+// 调用方需持有写锁
+func (s *memoryStore) join(fileName, id string, bf protocol.Bitfield) {
+	if s.swarms[fileName] == nil {
+		s.swarms[fileName] = make(map[string]protocol.Bitfield)
+	}
+	s.swarms[fileName][id] = bf
+	if s.joined[id] == nil {
+		s.joined[id] = make(map[string]struct{})
+	}
+	s.joined[id][fileName] = struct{}{}
+}
+
+func (s *memoryStore) Pieces(fileName, id string) (protocol.Bitfield, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bf, ok := s.swarms[fileName][id]
+	return append(protocol.Bitfield(nil), bf...), ok, nil
+}
+
+func (s *memoryStore) SwarmPieces(fileName string) (map[string]protocol.Bitfield, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	pieces := make(map[string]protocol.Bitfield, len(s.swarms[fileName]))
+	for id, bf := range s.swarms[fileName] {
+		pieces[id] = append(protocol.Bitfield(nil), bf...)
+	}
+	return pieces, nil
+}
+
+func (s *memoryStore) Leave(fileName, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.leave(fileName, id)
+	return nil
+}
+
+// 调用方需持有写锁
+func (s *memoryStore) leave(fileName, id string) {
+	delete(s.swarms[fileName], id)
+	if len(s.swarms[fileName]) == 0 {
+		delete(s.swarms, fileName)
+	}
+	delete(s.joined[id], fileName)
+}
+
+func (s *memoryStore) Members(fileName string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ids := make([]string, 0, len(s.swarms[fileName]))
+	for id := range s.swarms[fileName] {
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (s *memoryStore) PeerFiles(id string) ([]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	files := make([]string, 0, len(s.joined[id]))
+	for fileName := range s.joined[id] {
+		files = append(files, fileName)
+	}
+	return files, nil
+}
+
+func (s *memoryStore) DropSwarm(fileName string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ids := make([]string, 0, len(s.swarms[fileName]))
+	for id := range s.swarms[fileName] {
+		ids = append(ids, id)
+		delete(s.joined[id], fileName)
+	}
+	delete(s.swarms, fileName)
+	return ids, nil
+}
+
+func (s *memoryStore) PutBan(b Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.bans[b.Kind+":"+b.Value] = b
+	return nil
+}
+
+func (s *memoryStore) DeleteBan(kind, value string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.bans[kind+":"+value]
+	delete(s.bans, kind+":"+value)
+	return ok, nil
+}
+
+func (s *memoryStore) Bans() ([]Ban, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	bans := make([]Ban, 0, len(s.bans))
+	for _, b := range s.bans {
+		bans = append(bans, b)
+	}
+	return bans, nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
@@ -0,0 +1,98 @@
+package src
+
+//签发p2p访问凭证。追踪器持有一把Ed25519私钥，公钥在welcome中发给每个客户端。
+//客户端获取元数据时，追踪器给它签发这个文件的凭证；凭证快过期时客户端通过/ticket换新的。
+//其它客户端收到分片请求时只需用公钥验证凭证，不用再问服务器。
+
+import (
+	"Gdown/protocol"
+	"Gdown/server/src/config"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+var ticketKey ed25519.PrivateKey
+
+// 读取签发凭证的私钥，文件不存在时生成一把新的。文件中保存的是十六进制的私钥种子。
+// 私钥保存下来，服务器重启之后已经签发的凭证仍然有效
+func loadTicketKey(path string) (ed25519.PrivateKey, error) {
+	buf, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(path, []byte(hex.EncodeToString(key.Seed())+"\n"), 0600); err != nil {
+			return nil, err
+		}
+		log.Println("生成了新的凭证私钥", path)
+		return key, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("%s不是有效的凭证私钥", path)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// 验证凭证用的公钥
+func ticketPublicKey() ed25519.PublicKey {
+	return ticketKey.Public().(ed25519.PublicKey)
+}
+
+// 给客户端签发某个文件的凭证
+func issueTicket(cli *client, fileName string) (string, time.Time, error) {
+	t := protocol.Ticket{
+		User:     cli.User,
+		Host:     cli.host(),
+		FileName: fileName,
+		Expires:  time.Now().Add(config.Cfg.TicketTTL).Unix(),
+	}
+	s, err := protocol.SignTicket(t, ticketKey)
+	return s, t.ExpiresAt(), err
+}
+
+// 凭证快过期时，下载中的客户端通过这个接口换新的
+func sendTicket(c *gin.Context) {
+	var request struct {
+		FileName string `json:"file_name"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"message": "请求格式错误",
+		})
+		return
+	}
+	if _, ok := tracker.File(request.FileName); !ok {
+		c.JSON(http.StatusNotFound, gin.H{
+			"message": "文件不存在",
+		})
+		return
+	}
+	ticket, expires, err := issueTicket(requestPeer(c), request.FileName)
+	if err != nil {
+		log.Println("签发凭证失败：", err)
+		c.JSON(http.StatusInternalServerError, gin.H{
+			"message": "服务器内部错误",
+		})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "ok",
+		"ticket":         ticket,
+		"ticket_expires": expires.Unix(),
+	})
+}
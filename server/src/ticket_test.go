@@ -0,0 +1,32 @@
+package src
+
+import (
+	"Gdown/protocol"
+	"crypto/ed25519"
+	"testing"
+	"time"
+)
+
+func TestIssueTicket(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := ticketKey
+	ticketKey = priv
+	t.Cleanup(func() { ticketKey = old })
+
+	cli := &client{ID: "p1", User: "alice", IPAdr: "10.0.0.1:9000"}
+	s, _, err := issueTicket(cli, "a.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := protocol.VerifyTicket(s, ticketPublicKey(), time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	//凭证绑定追踪器看到的IP，不带端口，提供分片的客户端拿它和请求的来源IP比较
+	if got.User != "alice" || got.Host != "10.0.0.1" || got.FileName != "a.zip" {
+		t.Errorf("凭证内容为%+v", got)
+	}
+}
@@ -0,0 +1,632 @@
+package src
+
+//追踪器。维护服务器做种的文件、在线的客户端，以及每个文件有哪些客户端（swarm）。
+//gin的各个处理函数是并发执行的，所有的读写都要经过追踪器，不直接操作map。
+
+import (
+	"Gdown/protocol"
+	"Gdown/server/src/config"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// Tracker 追踪器
+type Tracker struct {
+	mu      sync.RWMutex
+	files   map[string]*FileInfo           //服务器做种的文件，从磁盘加载，不需要持久化
+	conns   map[string]*client             //在线客户端的websocket连接，key为客户端标识
+	exclude map[string]map[string]struct{} //被管理员移出swarm的客户端，文件名->客户端标识。文件更新或删除时清除
+	store   Store                          //客户端和swarm成员关系
+	pmu     sync.Mutex                     //分片记录的读-改-写
+	closing bool                           //服务器正在关闭，客户端断开时保留swarm记录，重启后还能用
+	active  sync.WaitGroup                 //Connect成功、还没有Disconnect的连接
+
+	bmu  sync.RWMutex   //bans的锁，添加和解除封禁时连同store一起更新
+	bans map[string]Ban //所有封禁，类型:值 -> 封禁。每个请求都要检查，启动时从store加载一次
+
+	amu     sync.Mutex                     //pending和timer的锁
+	pending map[string]map[string]struct{} //等待推送的分片变化，文件名->客户端标识
+	timer   *time.Timer                    //有待推送的变化时，announceDelay之后推送
+}
+
+const announceDelay = 500 * time.Millisecond //合并这段时间内的分片变化，一次推送
+
+var tracker = NewTracker(NewMemoryStore())
+
+// InitTracker 按配置文件创建追踪器的存储后端，并开始清理长时间离线的客户端。出错时直接退出
+func InitTracker() {
+	var store Store
+	switch config.Cfg.TrackerStore {
+	case "bolt":
+		var err error
+		store, err = NewBoltStore(config.Cfg.TrackerDB)
+		if err != nil {
+			log.Fatalf("打开追踪器数据库失败:%v", err)
+		}
+	default:
+		store = NewMemoryStore()
+	}
+	tracker = NewTracker(store)
+	tracker.restore()
+	var err error
+	if ticketKey, err = loadTicketKey(config.Cfg.TicketKey); err != nil {
+		log.Fatalf("读取凭证私钥失败:%v", err)
+	}
+	go tracker.expireLoop(config.Cfg.PeerTTL)
+}
+
+// 服务器重启后，把上次记录的客户端都视为刚刚在线，给它们peer_ttl的时间重新连接，
+// 否则服务器停机期间的时间也会被算进离线时间。封禁记录加载到内存
+func (t *Tracker) restore() {
+	peers, err := t.store.Peers()
+	if err != nil {
+		log.Fatalf("读取追踪器数据失败:%v", err)
+	}
+	bans, err := t.store.Bans()
+	if err != nil {
+		log.Fatalf("读取封禁记录失败:%v", err)
+	}
+	t.bmu.Lock()
+	for _, b := range bans {
+		t.bans[banKey(b.Kind, b.Value)] = b
+	}
+	t.bmu.Unlock()
+	for _, p := range peers {
+		t.touch(p.ID)
+	}
+	if len(peers) != 0 {
+		log.Println("恢复了", len(peers), "个客户端的记录")
+	}
+}
+
+// ErrPeerOwned 客户端标识已经属于其它用户
+var ErrPeerOwned = errors.New("客户端标识已被其它用户使用")
+
+// ErrExcluded 客户端已被管理员移出文件的swarm
+var ErrExcluded = errors.New("已被管理员移出这个文件的客户端列表")
+
+// NewTracker 使用指定的存储后端创建追踪器
+func NewTracker(store Store) *Tracker {
+	return &Tracker{
+		files:   make(map[string]*FileInfo),
+		conns:   make(map[string]*client),
+		exclude: make(map[string]map[string]struct{}),
+		store:   store,
+		bans:    make(map[string]Ban),
+		pending: make(map[string]map[string]struct{}),
+	}
+}
+
+// File 获取文件
+func (t *Tracker) File(fileName string) (*FileInfo, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	info, ok := t.files[fileName]
+	return info, ok
+}
+
+// Files 获取所有文件
+func (t *Tracker) Files() []*FileInfo {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	files := make([]*FileInfo, 0, len(t.files))
+	for _, info := range t.files {
+		files = append(files, info)
+	}
+	return files
+}
+
+// PutFile 添加文件，同名的旧文件会被替换
+func (t *Tracker) PutFile(info *FileInfo) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.files[info.FileName] = info
+	delete(t.exclude, info.FileName) //文件变了，被移出的客户端可以重新加入
+}
+
+// RemoveFile 移除文件
+func (t *Tracker) RemoveFile(fileName string) (*FileInfo, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	info, ok := t.files[fileName]
+	delete(t.files, fileName)
+	delete(t.exclude, fileName)
+	return info, ok
+}
+
+// CheckOwner 检查客户端标识是否可以由该用户使用。第一次出现的标识属于第一个使用它的用户
+func (t *Tracker) CheckOwner(id, user string) error {
+	p, ok, err := t.store.GetPeer(id)
+	if err != nil {
+		return err
+	}
+	if ok && p.User != user {
+		return ErrPeerOwned
+	}
+	return nil
+}
+
+// Connect 客户端上线，记录它公布的地址。同一个客户端重复连接时，旧的连接会被关闭
+func (t *Tracker) Connect(cli *client) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	p, ok, err := t.store.GetPeer(cli.ID)
+	if err != nil {
+		return err
+	}
+	if ok && p.User != cli.User {
+		return ErrPeerOwned
+	}
+	p.ID, p.User = cli.ID, cli.User
+	p.ConnectedAt, p.LastSeen = time.Now(), time.Now()
+	p.addAddr(cli.IPAdr)
+	if err = t.store.PutPeer(p); err != nil {
+		return err
+	}
+	if old := t.conns[cli.ID]; old != nil {
+		old.conn.Close()
+	}
+	t.conns[cli.ID] = cli
+	t.active.Add(1)
+	return nil
+}
+
+// Disconnect 客户端下线，退出所有swarm。如果这个连接已经被新的连接取代，则什么都不做。
+// 每次Connect成功之后必须调用一次
+func (t *Tracker) Disconnect(cli *client) {
+	defer t.active.Done()
+	t.mu.Lock()
+	if t.conns[cli.ID] != cli {
+		t.mu.Unlock()
+		return
+	}
+	delete(t.conns, cli.ID)
+	closing := t.closing
+	t.mu.Unlock()
+	t.touch(cli.ID)
+	if closing {
+		return
+	}
+	files, err := t.store.PeerFiles(cli.ID)
+	if err == nil {
+		err = t.store.LeaveAll(cli.ID)
+	}
+	if err != nil {
+		log.Println("客户端", cli.ID, "退出swarm失败：", err)
+		return
+	}
+	for _, fileName := range files {
+		t.notifySwarm(fileName, cli.ID, protocol.Peers{FileName: fileName, Removed: []string{cli.IPAdr}})
+	}
+}
+
+// Client 获取在线客户端
+func (t *Tracker) Client(id string) (*client, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	cli, ok := t.conns[id]
+	return cli, ok
+}
+
+// Join 客户端加入文件的swarm
+func (t *Tracker) Join(fileName, id string) error {
+	if t.Excluded(fileName, id) {
+		return ErrExcluded
+	}
+	return t.store.Join(fileName, id)
+}
+
+// Leave 客户端退出文件的swarm，返回客户端原来是否在swarm中
+func (t *Tracker) Leave(fileName, id string) (bool, error) {
+	_, ok, err := t.store.Pieces(fileName, id)
+	if err != nil || !ok {
+		return false, err
+	}
+	if err = t.store.Leave(fileName, id); err != nil {
+		return false, err
+	}
+	if p, ok, err := t.store.GetPeer(id); err == nil && ok {
+		t.notifySwarm(fileName, id, protocol.Peers{FileName: fileName, Removed: []string{p.Addr()}})
+	}
+	return true, nil
+}
+
+// Exclude 把客户端移出文件的swarm，并且不让它再加入，直到文件更新或服务器重启。返回客户端原来是否在swarm中
+func (t *Tracker) Exclude(fileName, id string) (bool, error) {
+	t.mu.Lock()
+	ids := t.exclude[fileName]
+	if ids == nil {
+		ids = make(map[string]struct{})
+		t.exclude[fileName] = ids
+	}
+	_, had := ids[id]
+	ids[id] = struct{}{} //先记下来，防止退出之后马上又加入
+	t.mu.Unlock()
+	ok, err := t.Leave(fileName, id)
+	if (err != nil || !ok) && !had {
+		t.mu.Lock()
+		delete(t.exclude[fileName], id)
+		t.mu.Unlock()
+	}
+	return ok, err
+}
+
+// Excluded 客户端是否被移出了文件的swarm
+func (t *Tracker) Excluded(fileName, id string) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	_, ok := t.exclude[fileName][id]
+	return ok
+}
+
+// Have 记录客户端新下载好的分片
+func (t *Tracker) Have(fileName, id string, pieces []int) error {
+	info, ok := t.File(fileName)
+	if !ok {
+		return fmt.Errorf("文件%s不存在", fileName)
+	}
+	for _, i := range pieces {
+		if i < 0 || i >= info.FilePiecesNum {
+			return fmt.Errorf("%s没有第%d个分片", fileName, i)
+		}
+	}
+	if t.Excluded(fileName, id) {
+		return ErrExcluded
+	}
+	t.pmu.Lock()
+	bf, _, err := t.store.Pieces(fileName, id)
+	if err != nil {
+		t.pmu.Unlock()
+		return err
+	}
+	if len(bf) != len(protocol.NewBitfield(info.FilePiecesNum)) {
+		bf = protocol.NewBitfield(info.FilePiecesNum)
+	}
+	for _, i := range pieces {
+		bf.Set(i)
+	}
+	err = t.store.SetPieces(fileName, id, bf)
+	t.pmu.Unlock()
+	if err != nil {
+		return err
+	}
+	t.announce(fileName, id)
+	return nil
+}
+
+// Complete 记录客户端拥有文件的全部分片
+func (t *Tracker) Complete(fileName, id string) error {
+	info, ok := t.File(fileName)
+	if !ok {
+		return fmt.Errorf("文件%s不存在", fileName)
+	}
+	if t.Excluded(fileName, id) {
+		return ErrExcluded
+	}
+	bf := protocol.FullBitfield(info.FilePiecesNum)
+	t.pmu.Lock()
+	err := t.store.SetPieces(fileName, id, bf)
+	t.pmu.Unlock()
+	if err != nil {
+		return err
+	}
+	t.announce(fileName, id)
+	return nil
+}
+
+// 记下id拥有的分片有了变化，稍后合并推送给swarm中的其它客户端。
+// 每个have都推送一次的话，swarm里N个客户端下载时消息数是N²
+func (t *Tracker) announce(fileName, id string) {
+	t.amu.Lock()
+	defer t.amu.Unlock()
+	ids := t.pending[fileName]
+	if ids == nil {
+		ids = make(map[string]struct{})
+		t.pending[fileName] = ids
+	}
+	ids[id] = struct{}{}
+	if t.timer == nil {
+		t.timer = time.AfterFunc(announceDelay, t.flushAnnounce)
+	}
+}
+
+// 推送积攒的分片变化，每个文件的每个接收者只收到一条消息，里面是发生变化的客户端的最新位图
+func (t *Tracker) flushAnnounce() {
+	t.amu.Lock()
+	pending := t.pending
+	t.pending = make(map[string]map[string]struct{})
+	t.timer = nil
+	t.amu.Unlock()
+
+	for fileName, ids := range pending {
+		info, ok := t.File(fileName)
+		if !ok {
+			continue
+		}
+		pieces, err := t.store.SwarmPieces(fileName)
+		if err != nil {
+			log.Println("获取", fileName, "的客户端列表失败：", err)
+			continue
+		}
+		var (
+			added []protocol.Peer
+			from  []string //added中每一项的客户端标识
+		)
+		for id := range ids {
+			bf, ok := pieces[id]
+			if !ok {
+				continue //已经离开了swarm，离开时已经推送过
+			}
+			p, ok, err := t.store.GetPeer(id)
+			if err != nil || !ok || p.Addr() == "" {
+				continue
+			}
+			added = append(added, protocol.Peer{Addr: p.Addr(), Bitfield: bf})
+			from = append(from, id)
+		}
+		for id, bf := range pieces {
+			if bf.Count() >= info.FilePiecesNum {
+				continue
+			}
+			delta := make([]protocol.Peer, 0, len(added))
+			for i, p := range added {
+				if from[i] != id { //不把客户端自己推送给它
+					delta = append(delta, p)
+				}
+			}
+			if len(delta) != 0 {
+				t.sendPeers(id, fileName, protocol.Peers{FileName: fileName, Added: delta})
+			}
+		}
+	}
+}
+
+// 向在线客户端推送swarm的变化
+func (t *Tracker) sendPeers(id, fileName string, delta protocol.Peers) {
+	cli, ok := t.Client(id)
+	if !ok {
+		return
+	}
+	if err := cli.send(protocol.TypePeers, delta); err != nil {
+		log.Println("向客户端", id, "推送", fileName, "的客户端变化失败：", err)
+	}
+}
+
+// 向swarm中除了exclude以外、还没有下载完的在线客户端推送变化。已经下载完的客户端用不到其它客户端
+func (t *Tracker) notifySwarm(fileName, exclude string, delta protocol.Peers) {
+	info, ok := t.File(fileName)
+	if !ok {
+		return
+	}
+	pieces, err := t.store.SwarmPieces(fileName)
+	if err != nil {
+		log.Println("获取", fileName, "的客户端列表失败：", err)
+		return
+	}
+	for id, bf := range pieces {
+		if id == exclude || bf.Count() >= info.FilePiecesNum {
+			continue
+		}
+		t.sendPeers(id, fileName, delta)
+	}
+}
+
+// Seeders 文件swarm中除了exclude以外、至少拥有一个分片的客户端
+func (t *Tracker) Seeders(fileName, exclude string) ([]protocol.Peer, error) {
+	pieces, err := t.store.SwarmPieces(fileName)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]protocol.Peer, 0, len(pieces))
+	for id, bf := range pieces {
+		if id == exclude || bf.Count() == 0 {
+			continue
+		}
+		p, ok, err := t.store.GetPeer(id)
+		if err != nil {
+			return nil, err
+		}
+		if ok && p.Addr() != "" {
+			peers = append(peers, protocol.Peer{Addr: p.Addr(), Bitfield: bf})
+		}
+	}
+	return peers, nil
+}
+
+// SeederCount 文件swarm中有分片可以提供的客户端数目，和Seeders一致，不算还什么都没有的下载者
+func (t *Tracker) SeederCount(fileName string) int {
+	pieces, err := t.store.SwarmPieces(fileName)
+	if err != nil {
+		log.Println("获取", fileName, "的客户端列表失败：", err)
+		return 0
+	}
+	n := 0
+	for _, bf := range pieces {
+		if bf.Count() > 0 {
+			n++
+		}
+	}
+	return n
+}
+
+// ResetSwarm 清空文件的swarm，返回原来在swarm中的在线客户端。文件变动或删除时调用
+func (t *Tracker) ResetSwarm(fileName string) []*client {
+	ids, err := t.store.DropSwarm(fileName)
+	if err != nil {
+		log.Println("清空", fileName, "的客户端列表失败：", err)
+		return nil
+	}
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	clients := make([]*client, 0, len(ids))
+	for _, id := range ids {
+		if cli, ok := t.conns[id]; ok {
+			clients = append(clients, cli)
+		}
+	}
+	return clients
+}
+
+// 更新客户端最近一次在线的时间
+func (t *Tracker) touch(id string) {
+	p, ok, err := t.store.GetPeer(id)
+	if err == nil && ok {
+		p.LastSeen = time.Now()
+		err = t.store.PutPeer(p)
+	}
+	if err != nil {
+		log.Println("更新客户端", id, "在线时间失败：", err)
+	}
+}
+
+// 定时清理离线超过ttl的客户端
+func (t *Tracker) expireLoop(ttl time.Duration) {
+	ticker := time.NewTicker(ttl / 4)
+	defer ticker.Stop()
+	for range ticker.C {
+		t.Expire(time.Now().Add(-ttl))
+	}
+}
+
+// Expire 删除before之前就已经离线的客户端，在线的客户端不受影响。返回删除的客户端数目
+func (t *Tracker) Expire(before time.Time) int {
+	peers, err := t.store.Peers()
+	if err != nil {
+		log.Println("获取客户端列表失败：", err)
+		return 0
+	}
+	n := 0
+	for _, p := range peers {
+		if _, online := t.Client(p.ID); online || !p.LastSeen.Before(before) {
+			continue
+		}
+		files, err := t.store.PeerFiles(p.ID)
+		if err == nil {
+			err = t.store.DeletePeer(p.ID)
+		}
+		if err != nil {
+			log.Println("清理客户端", p.ID, "失败：", err)
+			continue
+		}
+		n++
+		for _, fileName := range files {
+			t.notifySwarm(fileName, p.ID, protocol.Peers{FileName: fileName, Removed: []string{p.Addr()}})
+		}
+	}
+	if n != 0 {
+		log.Println("清理了", n, "个长时间离线的客户端")
+	}
+	return n
+}
+
+// Online 所有在线客户端
+func (t *Tracker) Online() []*client {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	clients := make([]*client, 0, len(t.conns))
+	for _, cli := range t.conns {
+		clients = append(clients, cli)
+	}
+	return clients
+}
+
+// Kick 断开客户端的websocket连接，断开之前告诉客户端原因。客户端不在线时返回false
+func (t *Tracker) Kick(id, reason string) bool {
+	cli, ok := t.Client(id)
+	if !ok {
+		return false
+	}
+	cli.sendNotice(reason)
+	cli.enqueue(nil) //发完原因之后关闭连接，serve会因为读取失败而退出，随后从追踪器中移除
+	return true
+}
+
+// Ban 添加封禁，并断开被封禁的在线客户端。返回断开的客户端数目
+func (t *Tracker) Ban(b Ban) (int, error) {
+	t.bmu.Lock()
+	if err := t.store.PutBan(b); err != nil {
+		t.bmu.Unlock()
+		return 0, err
+	}
+	t.bans[banKey(b.Kind, b.Value)] = b
+	t.bmu.Unlock()
+	n := 0
+	for _, cli := range t.Online() {
+		if matchBan(b, cli.User, cli.host()) && t.Kick(cli.ID, "已被管理员封禁："+b.Reason) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// Unban 解除封禁，返回封禁是否存在
+func (t *Tracker) Unban(kind, value string) (bool, error) {
+	t.bmu.Lock()
+	defer t.bmu.Unlock()
+	ok, err := t.store.DeleteBan(kind, value)
+	if err != nil {
+		return false, err
+	}
+	delete(t.bans, banKey(kind, value))
+	return ok, nil
+}
+
+// Bans 所有封禁
+func (t *Tracker) Bans() []Ban {
+	t.bmu.RLock()
+	defer t.bmu.RUnlock()
+	bans := make([]Ban, 0, len(t.bans))
+	for _, b := range t.bans {
+		bans = append(bans, b)
+	}
+	return bans
+}
+
+// Banned 用户或IP是否被封禁，返回命中的封禁
+func (t *Tracker) Banned(user, host string) (Ban, bool) {
+	t.bmu.RLock()
+	defer t.bmu.RUnlock()
+	if b, ok := t.bans[banKey(BanUser, user)]; ok {
+		return b, true
+	}
+	b, ok := t.bans[banKey(BanAddr, host)]
+	return b, ok
+}
+
+func banKey(kind, value string) string {
+	return kind + ":" + value
+}
+
+func matchBan(b Ban, user, host string) bool {
+	return (b.Kind == BanUser && b.Value == user) || (b.Kind == BanAddr && b.Value == host)
+}
+
+// Close 关闭服务器时调用。向所有客户端发送websocket关闭帧，等它们断开之后关闭存储
+func (t *Tracker) Close() {
+	t.mu.Lock()
+	t.closing = true
+	t.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, cli := range t.Online() {
+		wg.Add(1)
+		go func(cli *client) {
+			defer wg.Done()
+			cli.close(websocket.CloseGoingAway, "服务器关闭")
+		}(cli)
+	}
+	wg.Wait()
+	t.active.Wait() //等serve退出，Disconnect之后才能关闭存储
+	t.amu.Lock()
+	if t.timer != nil {
+		t.timer.Stop() //客户端都已经断开，不用再推送了
+	}
+	t.amu.Unlock()
+	if err := t.store.Close(); err != nil {
+		log.Println("关闭追踪器存储失败：", err)
+	}
+}
@@ -0,0 +1,210 @@
+package src
+
+import (
+	"Gdown/god"
+	"Gdown/protocol"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+// 收到的peers消息
+func receivedPeers(t *testing.T, cli *client) []protocol.Peers {
+	t.Helper()
+	var out []protocol.Peers
+	for {
+		select {
+		case buf := <-cli.out:
+			msg, err := protocol.Parse(buf)
+			if err != nil || msg.Type != protocol.TypePeers {
+				t.Fatalf("意外的消息：%s", buf)
+			}
+			var p protocol.Peers
+			if err = msg.Decode(&p); err != nil {
+				t.Fatal(err)
+			}
+			out = append(out, p)
+		default:
+			return out
+		}
+	}
+}
+
+// 一段时间内的多个have合并成一条消息，每个接收者只收到其它客户端的最新位图
+func TestAnnounceCoalesced(t *testing.T) {
+	tr := NewTracker(NewMemoryStore())
+	tr.PutFile(&FileInfo{Meta: god.Meta{FileName: "a.zip", FilePiecesNum: 4}})
+	clients := make(map[string]*client)
+	for id, addr := range map[string]string{"a": "10.0.0.1:9000", "b": "10.0.0.2:9000", "c": "10.0.0.3:9000"} {
+		cli := &client{ID: id, User: id, IPAdr: addr, out: make(chan []byte, sendQueueSize)}
+		if err := tr.Connect(cli); err != nil {
+			t.Fatal(err)
+		}
+		clients[id] = cli
+	}
+	if err := tr.Join("a.zip", "c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, have := range []struct {
+		id     string
+		pieces []int
+	}{{"a", []int{0}}, {"a", []int{1}}, {"b", []int{2}}} {
+		if err := tr.Have("a.zip", have.id, have.pieces); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tr.flushAnnounce()
+
+	want := map[string][]string{"a": {"10.0.0.2:9000"}, "b": {"10.0.0.1:9000"}, "c": {"10.0.0.1:9000", "10.0.0.2:9000"}}
+	for id, addrs := range want {
+		msgs := receivedPeers(t, clients[id])
+		if len(msgs) != 1 {
+			t.Fatalf("%s收到%d条消息，期望1条", id, len(msgs))
+		}
+		got := make(map[string]protocol.Bitfield)
+		for _, p := range msgs[0].Added {
+			got[p.Addr] = p.Bitfield
+		}
+		if len(got) != len(addrs) {
+			t.Fatalf("%s收到%v，期望%v", id, msgs[0].Added, addrs)
+		}
+		for _, addr := range addrs {
+			if _, ok := got[addr]; !ok {
+				t.Fatalf("%s没有收到%s的变化", id, addr)
+			}
+		}
+		if bf, ok := got["10.0.0.1:9000"]; ok && (!bf.Has(0) || !bf.Has(1) || bf.Count() != 2) {
+			t.Fatalf("a的位图不是最新的：%v", bf)
+		}
+	}
+}
+
+// 刚加入、还没有分片的下载者不算做种者，SeederCount和Seeders要一致
+func TestSeederCount(t *testing.T) {
+	tr := NewTracker(NewMemoryStore())
+	tr.PutFile(&FileInfo{Meta: god.Meta{FileName: "a.zip", FilePiecesNum: 4}})
+	for id, addr := range map[string]string{"a": "10.0.0.1:9000", "b": "10.0.0.2:9000", "c": "10.0.0.3:9000"} {
+		if err := tr.Connect(&client{ID: id, User: id, IPAdr: addr, out: make(chan []byte, sendQueueSize)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tr.Complete("a.zip", "a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Have("a.zip", "b", []int{1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tr.Join("a.zip", "c"); err != nil {
+		t.Fatal(err)
+	}
+	seeders, err := tr.Seeders("a.zip", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := tr.SeederCount("a.zip"); n != 2 || len(seeders) != n {
+		t.Errorf("SeederCount为%d，Seeders有%d个，期望都是2", n, len(seeders))
+	}
+}
+
+func TestBanned(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.PutBan(Ban{Kind: BanUser, Value: "mallory", Reason: "刷流量"}); err != nil {
+		t.Fatal(err)
+	}
+	tr := NewTracker(store)
+	tr.restore() //启动时从store加载
+	if b, ok := tr.Banned("mallory", "10.0.0.1"); !ok || b.Reason != "刷流量" {
+		t.Errorf("store中的封禁没有加载：%+v %v", b, ok)
+	}
+
+	if _, err := tr.Ban(Ban{Kind: BanAddr, Value: "10.0.0.2"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := tr.Banned("alice", "10.0.0.2"); !ok {
+		t.Error("封禁的IP应该被拦下")
+	}
+	if _, ok := tr.Banned("alice", "10.0.0.1"); ok {
+		t.Error("没有被封禁的用户和IP不应该被拦下")
+	}
+	if _, ok := tr.Banned("10.0.0.2", "10.0.0.1"); ok {
+		t.Error("用户名和IP的封禁不能混用")
+	}
+
+	if ok, err := tr.Unban(BanUser, "mallory"); err != nil || !ok {
+		t.Fatalf("解除封禁返回%v %v", ok, err)
+	}
+	if _, ok := tr.Banned("mallory", "10.0.0.1"); ok {
+		t.Error("解除封禁后不应该再被拦下")
+	}
+	bans, err := store.Bans()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || len(tr.Bans()) != 1 {
+		t.Errorf("store中有%d条封禁，追踪器中有%d条，期望都是1条", len(bans), len(tr.Bans()))
+	}
+}
+
+func TestMemoryStore(t *testing.T) {
+	store := NewMemoryStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := "127.0.0.1:" + strconv.Itoa(10000+i)
+			store.PutPeer(Peer{ID: id, Addrs: []string{id}})
+			store.Join("a.mp4", id)
+			store.Join("b.mp4", id)
+			if i%2 == 0 {
+				store.DeletePeer(id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	members, _ := store.Members("a.mp4")
+	if len(members) != 25 {
+		t.Fatalf("期望25个客户端，得到%d个", len(members))
+	}
+	dropped, _ := store.DropSwarm("b.mp4")
+	files, _ := store.PeerFiles(dropped[0])
+	if len(dropped) != 25 || len(files) != 1 || files[0] != "a.mp4" {
+		t.Fatalf("清空swarm结果错误：%d %v", len(dropped), files)
+	}
+}
+
+func TestBoltStoreReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tracker.db")
+	store, err := NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.PutPeer(Peer{ID: "p1", User: "alice", Addrs: []string{"10.0.0.1:9000"}})
+	store.PutPeer(Peer{ID: "p2", User: "bob", Addrs: []string{"10.0.0.2:9000"}})
+	store.SetPieces("a.mp4", "p1", protocol.FullBitfield(3))
+	store.Join("a.mp4", "p2")
+	store.Join("b.mp4", "p2")
+	store.DeletePeer("p2")
+	if err = store.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err = NewBoltStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	p, ok, _ := store.GetPeer("p1")
+	if !ok || p.User != "alice" || p.Addr() != "10.0.0.1:9000" {
+		t.Fatalf("重新打开后客户端记录错误：%+v", p)
+	}
+	pieces, _ := store.SwarmPieces("a.mp4")
+	if len(pieces) != 1 || pieces["p1"].Count() != 3 {
+		t.Fatalf("重新打开后swarm记录错误：%v", pieces)
+	}
+	if members, _ := store.Members("b.mp4"); len(members) != 0 {
+		t.Fatalf("已删除的客户端仍在swarm中：%v", members)
+	}
+}
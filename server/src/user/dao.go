@@ -1,6 +1,7 @@
 package user
 
 import (
+	"Gdown/server/src/config"
 	"errors"
 	"log"
 
@@ -13,13 +14,20 @@ import (
 var db *gorm.DB
 
 func InitDB() {
-	dsn := "root:42424242@tcp(127.0.0.1:3306)/gdown"
-	database, err := gorm.Open(mysql.Open(dsn), &gorm.Config{})
+	database, err := gorm.Open(mysql.Open(config.Cfg.MysqlDSN), &gorm.Config{})
 	if err != nil {
 		log.Println("mysql初始化错误:", err)
 		return
 	}
 	db = database
+	if err = db.AutoMigrate(&RevokedToken{}); err != nil {
+		log.Println("创建token注销表错误:", err)
+		return
+	}
+	if err = loadRevoked(); err != nil {
+		log.Println("加载token注销记录错误:", err)
+	}
+	go reloadRevoked()
 }
 
 func findUserByUsername(username string) (err error, user User) {
@@ -39,3 +47,8 @@ func dbLogin(username string) (user User, err error) {
 	err = db.Where("username=?", username).First(&user).Error
 	return user, err
 }
+
+// 把明文密码换成哈希。只在密码仍是原来的明文时更新，避免覆盖同时修改的结果
+func dbUpgradePassword(user User, hash string) error {
+	return db.Model(&User{}).Where("id=? AND password=?", user.Id, user.Password).Update("password", hash).Error
+}
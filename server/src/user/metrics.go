@@ -0,0 +1,12 @@
+package user
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// 登录次数，result为success或failure（格式错误、用户名不存在、密码错误、服务器错误，所有没有拿到token的登录都算）
+var loginTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+	Name: "gdown_logins_total",
+	Help: "登录次数",
+}, []string{"result"})
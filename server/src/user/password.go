@@ -0,0 +1,33 @@
+package user
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+//密码用bcrypt保存。旧版本保存的是明文，登录成功时顺便换成bcrypt
+
+// bcrypt只能处理72字节以内的密码，更长的注册时直接拒绝
+const maxPasswordLen = 72
+
+// 计算密码的bcrypt哈希
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
+
+// 是否是bcrypt哈希，否则是旧版本保存的明文
+func isHashed(stored string) bool {
+	return strings.HasPrefix(stored, "$2a$") || strings.HasPrefix(stored, "$2b$") || strings.HasPrefix(stored, "$2y$")
+}
+
+// 核对密码。upgrade为true表示数据库里还是明文，需要换成哈希
+func checkPassword(stored, password string) (ok, upgrade bool) {
+	if isHashed(stored) {
+		return bcrypt.CompareHashAndPassword([]byte(stored), []byte(password)) == nil, false
+	}
+	ok = subtle.ConstantTimeCompare([]byte(stored), []byte(password)) == 1
+	return ok, ok
+}
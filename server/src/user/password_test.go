@@ -0,0 +1,73 @@
+package user
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCheckPassword(t *testing.T) {
+	hashed, err := hashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !isHashed(hashed) {
+		t.Fatalf("%q应该是bcrypt哈希", hashed)
+	}
+
+	tests := []struct {
+		name             string
+		stored, password string
+		ok, upgrade      bool
+	}{
+		{"哈希匹配", hashed, "secret", true, false},
+		{"哈希不匹配", hashed, "wrong", false, false},
+		{"明文匹配，需要换成哈希", "secret", "secret", true, true},
+		{"明文不匹配", "secret", "wrong", false, false},
+		{"明文为空", "", "secret", false, false},
+	}
+	for _, tt := range tests {
+		ok, upgrade := checkPassword(tt.stored, tt.password)
+		if ok != tt.ok || upgrade != tt.upgrade {
+			t.Errorf("%s：ok=%v upgrade=%v，期望ok=%v upgrade=%v", tt.name, ok, upgrade, tt.ok, tt.upgrade)
+		}
+	}
+}
+
+func TestIsHashed(t *testing.T) {
+	for stored, want := range map[string]bool{
+		"$2a$10$abcdefghijklmnopqrstuv": true,
+		"$2b$10$abcdefghijklmnopqrstuv": true,
+		"$2y$10$abcdefghijklmnopqrstuv": true,
+		"$1$abc":                        false, //md5crypt
+		"password":                      false,
+		"":                              false,
+	} {
+		if got := isHashed(stored); got != want {
+			t.Errorf("isHashed(%q)=%v，期望%v", stored, got, want)
+		}
+	}
+}
+
+// 超过72字节的密码bcrypt处理不了，Register要在哈希之前拒绝
+func TestPasswordTooLong(t *testing.T) {
+	if _, err := hashPassword(strings.Repeat("a", maxPasswordLen)); err != nil {
+		t.Fatal("72字节的密码应该可以哈希：", err)
+	}
+	if _, err := hashPassword(strings.Repeat("a", maxPasswordLen+1)); err == nil {
+		t.Fatal("超过72字节时bcrypt应该报错")
+	}
+
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	body := `{"username":"bob","password":"` + strings.Repeat("a", maxPasswordLen+1) + `"}`
+	c.Request = httptest.NewRequest(http.MethodPost, "/user/register", strings.NewReader(body))
+	Register(c) //在查询数据库之前就返回
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("注册超长密码：状态码%d，期望400", w.Code)
+	}
+}
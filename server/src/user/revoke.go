@@ -0,0 +1,87 @@
+package user
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gorm.io/gorm/clause"
+)
+
+//已注销的token。退出登录、refresh token换过新token之后，旧的token在过期之前都不能再用。
+//校验token只查内存，不访问数据库；数据库只用来持久保存，服务器重启之后还在，多个服务器进程共用。
+//启动时从数据库加载一次，之后每隔revokedReload重新加载，别的进程注销的token最多这么久之后也会失效。过期的记录顺手清理掉。
+
+// RevokedToken 已注销的token，按token的唯一标识（jti）记录
+type RevokedToken struct {
+	Jti       string    `gorm:"primaryKey;size:32"`
+	ExpiresAt time.Time `gorm:"index"` //token本来的过期时间，过了这个时间记录就没用了
+}
+
+var revoked = struct {
+	sync.Mutex
+	tokens map[string]time.Time
+}{tokens: make(map[string]time.Time)}
+
+const revokedReload = time.Minute //重新从数据库加载注销记录的间隔
+
+// 定时重新加载注销记录。数据库出错时保留内存里已有的记录，不影响校验
+func reloadRevoked() {
+	for range time.Tick(revokedReload) {
+		if err := loadRevoked(); err != nil {
+			log.Println("重新加载token注销记录错误:", err)
+		}
+	}
+}
+
+// 从数据库加载还没过期的注销记录
+func loadRevoked() error {
+	var rows []RevokedToken
+	if err := db.Where("expires_at > ?", time.Now()).Find(&rows).Error; err != nil {
+		return err
+	}
+	revoked.Lock()
+	defer revoked.Unlock()
+	for _, r := range rows {
+		revoked.tokens[r.Jti] = r.ExpiresAt
+	}
+	return nil
+}
+
+// token是否已经注销
+func isRevoked(jti string) bool {
+	revoked.Lock()
+	defer revoked.Unlock()
+	_, ok := revoked.tokens[jti]
+	return ok
+}
+
+// 注销token。已经注销过时返回false，refresh token据此保证只能用一次
+func revoke(jti string, expiresAt time.Time) (bool, error) {
+	revoked.Lock()
+	defer revoked.Unlock()
+	if _, ok := revoked.tokens[jti]; ok {
+		return false, nil
+	}
+	now := time.Now()
+	for k, exp := range revoked.tokens {
+		if exp.Before(now) {
+			delete(revoked.tokens, k)
+		}
+	}
+	if db != nil {
+		if err := db.Where("expires_at < ?", now).Delete(&RevokedToken{}).Error; err != nil {
+			return false, err
+		}
+		result := db.Clauses(clause.OnConflict{DoNothing: true}).Create(&RevokedToken{Jti: jti, ExpiresAt: expiresAt})
+		if result.Error != nil {
+			return false, result.Error
+		}
+		if result.RowsAffected == 0 { //别的服务器进程已经注销过了，还没来得及加载到内存
+			revoked.tokens[jti] = expiresAt
+			return false, nil
+		}
+	}
+	revoked.tokens[jti] = expiresAt
+	return true, nil
+}
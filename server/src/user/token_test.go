@@ -0,0 +1,181 @@
+package user
+
+import (
+	"Gdown/server/src/config"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	testSecret = "0123456789abcdef0123456789abcdef"
+	testKey1   = "k1-secret-k1-secret-k1-secret-k1"
+	testKey2   = "k2-secret-k2-secret-k2-secret-k2"
+)
+
+// 换成测试用的秘钥，测试结束后恢复
+func setupTokens(t *testing.T) {
+	old := config.Cfg
+	t.Cleanup(func() { config.Cfg = old })
+	config.Cfg = config.Default()
+	config.Cfg.TokenSecret = testSecret
+	config.Cfg.TokenKeys = map[string]string{"k1": testKey1}
+	config.Cfg.TokenKeyID = "k1"
+}
+
+func TestKeyRotation(t *testing.T) {
+	setupTokens(t)
+	user := User{Id: 1, Username: "alice"}
+	old, err := generateToken(user, tokenAccess, config.Cfg.AccessTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//加入新秘钥并用它签发，旧秘钥签发的token仍然有效
+	config.Cfg.TokenKeys = map[string]string{"k1": testKey1, "k2": testKey2}
+	config.Cfg.TokenKeyID = "k2"
+	claims, err := ParseToken(old)
+	if err != nil {
+		t.Fatalf("轮换后旧token应该仍然有效：%v", err)
+	}
+	if claims.UserID != 1 || claims.Username != "alice" {
+		t.Errorf("身份信息为%d %q，期望1 \"alice\"", claims.UserID, claims.Username)
+	}
+	token, err := generateToken(user, tokenAccess, config.Cfg.AccessTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseToken(token); err != nil {
+		t.Fatalf("新秘钥签发的token无效：%v", err)
+	}
+
+	//删掉旧秘钥之后，它签发的token失效，新的不受影响
+	config.Cfg.TokenKeys = map[string]string{"k2": testKey2}
+	if _, err = ParseToken(old); err == nil {
+		t.Error("旧秘钥删除后，它签发的token应该失效")
+	}
+	if _, err = ParseToken(token); err != nil {
+		t.Errorf("删除旧秘钥不应该影响新token：%v", err)
+	}
+
+	//kid相同但秘钥被换掉，签名对不上
+	config.Cfg.TokenKeys = map[string]string{"k2": testKey1}
+	if _, err = ParseToken(token); err == nil {
+		t.Error("秘钥被替换后token应该失效")
+	}
+}
+
+func TestTokenWithoutKid(t *testing.T) {
+	setupTokens(t)
+	config.Cfg.TokenKeyID = ""
+	token, err := generateToken(User{Id: 1, Username: "alice"}, tokenAccess, config.Cfg.AccessTokenTTL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ParseToken(token); err != nil {
+		t.Fatalf("token_secret签发的token无效：%v", err)
+	}
+	config.Cfg.TokenSecret = testKey2
+	if _, err = ParseToken(token); err == nil {
+		t.Error("更换token_secret后旧token应该失效")
+	}
+}
+
+func TestTokenType(t *testing.T) {
+	setupTokens(t)
+	tokens, err := issueTokens(User{Id: 1, Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, refresh := tokens["token"].(string), tokens["refresh_token"].(string)
+	if _, err = ParseToken(access); err != nil {
+		t.Errorf("access token无效：%v", err)
+	}
+	if _, err = parseToken(refresh, tokenRefresh); err != nil {
+		t.Errorf("refresh token无效：%v", err)
+	}
+	if _, err = ParseToken(refresh); err == nil {
+		t.Error("refresh token不能当作access token使用")
+	}
+	if _, err = parseToken(access, tokenRefresh); err == nil {
+		t.Error("access token不能当作refresh token使用")
+	}
+}
+
+func TestLegacyToken(t *testing.T) {
+	setupTokens(t)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims Claims
+	}{
+		{"没有jti和typ", Claims{UserID: 1, Username: "alice", StandardClaims: jwt.StandardClaims{IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}}},
+		{"没有jti", Claims{UserID: 1, Username: "alice", Type: tokenAccess, StandardClaims: jwt.StandardClaims{IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}}},
+		{"没有typ", Claims{UserID: 1, Username: "alice", StandardClaims: jwt.StandardClaims{Id: "legacy", IssuedAt: now.Unix(), ExpiresAt: now.Add(time.Hour).Unix()}}},
+	}
+	for _, tt := range tests {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, tt.claims)
+		token.Header["kid"] = "k1"
+		signed, err := token.SignedString([]byte(testKey1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = ParseToken(signed); err == nil {
+			t.Errorf("%s：旧版本的token应该被拒绝", tt.name)
+		}
+	}
+}
+
+func TestLogoutRevokes(t *testing.T) {
+	setupTokens(t)
+	gin.SetMode(gin.TestMode)
+	tokens, err := issueTokens(User{Id: 1, Username: "alice"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	access, refresh := tokens["token"].(string), tokens["refresh_token"].(string)
+	other, err := issueTokens(User{Id: 2, Username: "bob"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.POST("/user/logout", Logout)
+	req := httptest.NewRequest(http.MethodPost, "/user/logout", strings.NewReader(`{"refresh_token":"`+refresh+`"}`))
+	req.Header.Set("Authorization", access)
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("退出登录返回%d：%s", w.Code, w.Body.String())
+	}
+
+	if _, err = ParseToken(access); err == nil {
+		t.Error("退出登录后access token应该失效")
+	}
+	if _, err = parseToken(refresh, tokenRefresh); err == nil {
+		t.Error("退出登录后refresh token应该失效")
+	}
+	if _, err = ParseToken(other["token"].(string)); err != nil {
+		t.Errorf("其它用户的token不应该受影响：%v", err)
+	}
+
+	//注销过的token再注销一次返回false，refresh token据此只能用一次
+	claims, err := parseToken(other["refresh_token"].(string), tokenRefresh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, want := range []bool{true, false} {
+		ok, err := revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != want {
+			t.Errorf("第%d次注销返回%v，期望%v", i+1, ok, want)
+		}
+	}
+}
@@ -1,16 +1,19 @@
 package user
 
 import (
+	"Gdown/server/src/config"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"log"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 	"github.com/gin-gonic/gin"
+	"gorm.io/gorm"
 )
 
-const tokenSecret = "MHcCAQEEIDmdyHY5w5w24RA1embdpeFjAORml1L9LhX2E3HFFHHhoAoGCCqGSM49AwEHoUQDQgAETZfbJRz5nkLy/mgwWUDURpiz3ZpMhEdw7SLQq1axt84zMSjGHvJOX2rcEzFsWo9E/GmVvdFUoDPNl1WIOQTIqg==" //token jwt秘钥
-
 type User struct {
 	Id       int
 	Username string `json:"username"`
@@ -29,6 +32,13 @@ func Register(c *gin.Context) {
 		log.Println(err)
 		return
 	}
+	if len(reg.Password) > maxPasswordLen {
+		c.JSON(400, gin.H{
+			"status":  400,
+			"message": "密码不能超过72个字节",
+		})
+		return
+	}
 
 	//在数据库中检查用户名是否已经被注册过
 	err, u := findUserByUsername(reg.Username)
@@ -47,7 +57,16 @@ func Register(c *gin.Context) {
 		return
 	}
 
-	//将用户信息填入数据库
+	//将用户信息填入数据库，密码只保存哈希
+	reg.Password, err = hashPassword(reg.Password)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"status":  500,
+			"message": "服务器内部错误",
+		})
+		log.Println(err)
+		return
+	}
 	err = dbRegister(reg)
 	if err != nil {
 		c.JSON(500, gin.H{
@@ -76,90 +95,287 @@ func Login(c *gin.Context) {
 			"message": "登录信息格式错误",
 			"token":   "",
 		})
+		loginTotal.WithLabelValues("failure").Inc()
 		log.Println(err)
 		return
 	}
 
-	//连接数据库，进行用户信息核对
+	//连接数据库，进行用户信息核对。用户名不存在时First返回ErrRecordNotFound
 	user, err := dbLogin(login.Username)
-	if err != nil {
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
 		c.JSON(500, gin.H{
 			"status":  500,
 			"message": "服务器内部错误",
 			"token":   "",
 		})
+		loginTotal.WithLabelValues("failure").Inc()
 		log.Println(err)
 		return
 	}
-	if user == (User{}) {
+	if user == (User{}) { //用户名不存在也要计数，否则拿随便编的用户名撞库不会在监控里留下痕迹
 		c.JSON(403, gin.H{
 			"status":  403,
 			"message": "用户名不存在",
 			"token":   "",
 		})
-		log.Println(err)
+		loginTotal.WithLabelValues("failure").Inc()
 		return
 	}
-	if user.Password != login.Password {
+	ok, upgrade := checkPassword(user.Password, login.Password)
+	if !ok {
 		c.JSON(403, gin.H{
 			"status":  403,
 			"message": "密码错误",
 			"token":   "",
 		})
-		log.Println(err)
+		loginTotal.WithLabelValues("failure").Inc()
 		return
 	}
+	if upgrade { //旧账号的明文密码，换成哈希。失败了也不影响这次登录，下次再换
+		if hash, err := hashPassword(login.Password); err != nil {
+			log.Println("计算", user.Username, "的密码哈希失败：", err)
+		} else if err = dbUpgradePassword(user, hash); err != nil {
+			log.Println("更新", user.Username, "的密码哈希失败：", err)
+		}
+	}
 
 	//生成token
-	token, err := generateToken()
+	tokens, err := issueTokens(user)
 	if err != nil {
 		c.JSON(500, gin.H{
 			"status":  500,
 			"message": "服务器内部错误",
 			"token":   "",
 		})
+		loginTotal.WithLabelValues("failure").Inc()
 		log.Println(err)
 		return
 	}
 
 	//返回成功消息
+	loginTotal.WithLabelValues("success").Inc()
+	tokens["message"] = "登录成功"
+	c.JSON(200, tokens)
+}
+
+// Refresh 用refresh token换一对新的token。旧的refresh token随即注销，只能用一次
+func Refresh(c *gin.Context) {
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := c.BindJSON(&request); err != nil {
+		c.JSON(400, gin.H{
+			"status":  400,
+			"message": "请求格式错误",
+		})
+		return
+	}
+	claims, err := parseToken(request.RefreshToken, tokenRefresh)
+	if err != nil {
+		c.JSON(401, gin.H{
+			"status":  401,
+			"message": "refresh token无效，请重新登录",
+		})
+		return
+	}
+	//用户可能已经被删除了
+	user, err := dbLogin(claims.Username)
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		c.JSON(500, gin.H{
+			"status":  500,
+			"message": "服务器内部错误",
+		})
+		log.Println(err)
+		return
+	}
+	if user.Id != claims.UserID {
+		c.JSON(401, gin.H{
+			"status":  401,
+			"message": "用户不存在，请重新登录",
+		})
+		return
+	}
+	ok, err := revoke(claims.Id, time.Unix(claims.ExpiresAt, 0))
+	if err != nil {
+		c.JSON(500, gin.H{
+			"status":  500,
+			"message": "服务器内部错误",
+		})
+		log.Println(err)
+		return
+	}
+	if !ok { //同时用同一个refresh token换了两次
+		c.JSON(401, gin.H{
+			"status":  401,
+			"message": "refresh token已失效，请重新登录",
+		})
+		return
+	}
+	tokens, err := issueTokens(user)
+	if err != nil {
+		c.JSON(500, gin.H{
+			"status":  500,
+			"message": "服务器内部错误",
+		})
+		log.Println(err)
+		return
+	}
+	tokens["message"] = "ok"
+	c.JSON(200, tokens)
+}
+
+// Logout 退出登录，注销Authorization中的access token，以及请求中的refresh token
+func Logout(c *gin.Context) {
+	claims, err := ParseToken(c.GetHeader("Authorization"))
+	if err != nil {
+		c.JSON(401, gin.H{
+			"status":  401,
+			"message": "未授权",
+		})
+		return
+	}
+	var request struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	_ = c.ShouldBindJSON(&request) //refresh token是可选的
+	expired := []*Claims{claims}
+	if request.RefreshToken != "" {
+		refresh, err := parseToken(request.RefreshToken, tokenRefresh)
+		if err == nil && refresh.UserID == claims.UserID && refresh.Username == claims.Username {
+			expired = append(expired, refresh)
+		}
+	}
+	for _, t := range expired {
+		if _, err = revoke(t.Id, time.Unix(t.ExpiresAt, 0)); err != nil {
+			c.JSON(500, gin.H{
+				"status":  500,
+				"message": "服务器内部错误",
+			})
+			log.Println(err)
+			return
+		}
+	}
 	c.JSON(200, gin.H{
 		"status":  200,
-		"message": "登录成功",
-		"token":   token,
+		"message": "已退出登录",
 	})
 }
 
-// 生成token
-func generateToken() (string, error) {
-	//使用jwt生成token
-	token := jwt.New(jwt.SigningMethodHS256)
-	claims := token.Claims.(jwt.MapClaims)
-	claims["exp"] = time.Now().Add(time.Hour * 24 * 7).Unix() //token有效期为7天
-	claims["iat"] = time.Now().Unix()
-	tokenString, err := token.SignedString([]byte(tokenSecret))
-	return tokenString, err
+// token的用途
+const (
+	tokenAccess  = "access"  //访问接口，有效期短
+	tokenRefresh = "refresh" //只能用来换新的token
+)
+
+// Claims token中携带的身份信息
+type Claims struct {
+	UserID   int    `json:"uid"`
+	Username string `json:"username"` //追踪器据此将客户端与用户对应起来
+	Type     string `json:"typ"`      //token的用途
+	jwt.StandardClaims
 }
 
-// ParseToken 解析token
-func ParseToken(tokenString string) (bool, error) {
-	token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-		return []byte(tokenSecret), nil
-	})
+// 签发一对新的token，作为登录和刷新的响应
+func issueTokens(user User) (gin.H, error) {
+	access, err := generateToken(user, tokenAccess, config.Cfg.AccessTokenTTL)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	if !token.Valid {
-		return false, nil
+	refresh, err := generateToken(user, tokenRefresh, config.Cfg.RefreshTokenTTL)
+	if err != nil {
+		return nil, err
+	}
+	return gin.H{
+		"status":        200,
+		"token":         access,
+		"refresh_token": refresh,
+		"expires_in":    int(config.Cfg.AccessTokenTTL.Seconds()), //access token多少秒后过期
+	}, nil
+}
+
+// 生成token，用配置中token_key_id指定的秘钥签名
+func generateToken(user User, typ string, ttl time.Duration) (string, error) {
+	jti, err := newTokenID()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	claims := Claims{
+		UserID:   user.Id,
+		Username: user.Username,
+		Type:     typ,
+		StandardClaims: jwt.StandardClaims{
+			Id:        jti,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(ttl).Unix(),
+		},
 	}
-	expFloat64, ok := token.Claims.(jwt.MapClaims)["exp"].(float64)
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	kid := config.Cfg.TokenKeyID
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	secret, ok := signingKey(kid)
 	if !ok {
-		return false, fmt.Errorf("无法解析 token 的 exp 字段")
+		return "", fmt.Errorf("秘钥%q不存在", kid)
+	}
+	return token.SignedString(secret)
+}
+
+// token的唯一标识
+func newTokenID() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
 	}
-	exp := int64(expFloat64)
+	return hex.EncodeToString(buf), nil
+}
 
-	if time.Now().Unix() > exp {
-		return false, nil
+// 按kid查找秘钥。没有kid的token（包括旧版本签发的）用token_secret
+func signingKey(kid string) ([]byte, bool) {
+	if kid == "" {
+		return []byte(config.Cfg.TokenSecret), true
+	}
+	secret, ok := config.Cfg.TokenKeys[kid]
+	return []byte(secret), ok
+}
+
+// ParseToken 校验access token的签名、有效期和是否已注销，返回其中的身份信息
+func ParseToken(tokenString string) (*Claims, error) {
+	return parseToken(tokenString, tokenAccess)
+}
+
+// 校验指定用途的token
+func parseToken(tokenString, typ string) (*Claims, error) {
+	claims := new(Claims)
+	_, err := jwt.ParseWithClaims(tokenString, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("不支持的签名算法%v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		secret, ok := signingKey(kid)
+		if !ok {
+			return nil, fmt.Errorf("秘钥%q不存在", kid)
+		}
+		return secret, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if claims.ExpiresAt == 0 {
+		return nil, errors.New("token没有有效期")
+	}
+	if claims.Username == "" {
+		return nil, errors.New("token中没有用户名，请重新登录")
+	}
+	if claims.Id == "" || claims.Type == "" { //旧版本签发的token没有唯一标识，无法注销，要求重新登录
+		return nil, errors.New("token版本过旧，请重新登录")
+	}
+	if claims.Type != typ {
+		return nil, fmt.Errorf("不是%s token", typ)
+	}
+	if isRevoked(claims.Id) {
+		return nil, errors.New("token已注销")
 	}
-	return true, nil
+	return claims, nil
 }
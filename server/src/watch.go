@@ -0,0 +1,193 @@
+package src
+
+//监视file目录，实现不重启服务器发布新文件。
+//新增或修改的文件重新分片做种，删除的文件从文件列表中移除。正在做种的客户端会通过websocket收到通知。
+//目录分享中任意文件的变动，都会让整个目录重新做种。fsnotify不支持递归监视，子目录需要逐个添加。
+
+import (
+	"Gdown/protocol"
+	"Gdown/server/src/config"
+	"errors"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+const watchDelay = 2 * time.Second //文件复制的过程中会产生大量写事件，停止变动一段时间后再处理
+
+// WatchFile 持续监视file目录。阻塞运行，在LoadFile之后启动。
+func WatchFile() {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		log.Println("创建文件监视器失败：", err)
+		return
+	}
+	defer watcher.Close()
+	err = watchTree(watcher, config.Cfg.FileDir)
+	if err != nil {
+		log.Println("监视file目录失败：", err)
+		return
+	}
+
+	var (
+		timers = make(map[string]*time.Timer) //每个文件一个定时器，用于合并短时间内的多次事件
+		mu     sync.Mutex
+	)
+	for {
+		select {
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			name := shareName(event.Name)
+			if name == "" || skipFile(name) || event.Op == fsnotify.Chmod {
+				continue
+			}
+			if event.Op&fsnotify.Create != 0 {
+				if stat, err := os.Stat(event.Name); err == nil && stat.IsDir() {
+					if err = watchTree(watcher, event.Name); err != nil {
+						log.Println("监视目录", event.Name, "失败：", err)
+					}
+				}
+			}
+			mu.Lock()
+			if t, ok := timers[name]; ok {
+				t.Reset(watchDelay)
+			} else {
+				timers[name] = time.AfterFunc(watchDelay, func() {
+					mu.Lock()
+					delete(timers, name)
+					mu.Unlock()
+					reloadFile(name)
+				})
+			}
+			mu.Unlock()
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+			log.Println("文件监视器错误：", err)
+		}
+	}
+}
+
+// 监视root及其下的所有子目录
+func watchTree(watcher *fsnotify.Watcher, root string) error {
+	return filepath.WalkDir(root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return watcher.Add(name)
+		}
+		return nil
+	})
+}
+
+// 事件路径所属的分享名，即file目录下的第一级文件或目录
+func shareName(name string) string {
+	rel, err := filepath.Rel(config.Cfg.FileDir, name)
+	if err != nil || rel == "." || strings.HasPrefix(rel, "..") {
+		return ""
+	}
+	return strings.SplitN(filepath.ToSlash(rel), "/", 2)[0]
+}
+
+// 正在重新加载的文件。定时器只能合并还没触发的事件，上一次加载还没完成时又来了事件，
+// 同一个文件的两次加载会同时写元数据文件，这里让它们排队
+var reloading = struct {
+	sync.Mutex
+	names map[string]*reloadLock
+}{names: make(map[string]*reloadLock)}
+
+type reloadLock struct {
+	sync.Mutex
+	waiters int //持有和等待这把锁的加载数目，为0时从names中删除
+}
+
+// 锁住文件的加载，返回解锁函数
+func lockReload(name string) func() {
+	reloading.Lock()
+	l, ok := reloading.names[name]
+	if !ok {
+		l = new(reloadLock)
+		reloading.names[name] = l
+	}
+	l.waiters++
+	reloading.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		reloading.Lock()
+		l.waiters--
+		if l.waiters == 0 {
+			delete(reloading.names, name)
+		}
+		reloading.Unlock()
+	}
+}
+
+// 根据文件的当前状态重新做种或者移除文件
+func reloadFile(name string) {
+	defer lockReload(name)()
+	_, had := tracker.File(name)
+	stat, err := os.Stat(filePath(name))
+	if errors.Is(err, fs.ErrNotExist) {
+		if had {
+			unloadFile(name, "文件已删除，停止做种")
+		}
+		return
+	}
+	if err != nil {
+		log.Println(name, "获取文件信息失败：", err)
+		return
+	}
+	if !stat.Mode().IsRegular() && !stat.IsDir() {
+		return
+	}
+
+	handles.evict(filePath(name)) //缓存的句柄可能指向已经被替换的文件
+	info := handelFile(fs.FileInfoToDirEntry(stat))
+	if info == nil {
+		if had { //旧的元数据和文件已经对不上了，不能继续用它做种
+			unloadFile(name, "重新分片失败，停止做种")
+		}
+		return
+	}
+	if had {
+		log.Println(name, "文件已更新，重新做种")
+		notifySeeders(name, protocol.TypeChanged) //客户端手里的旧文件已经对不上新的元数据了
+	} else {
+		log.Println(name, "新增文件，开始做种")
+	}
+}
+
+// 移除文件，删除元数据文件，通知正在做种的客户端
+func unloadFile(name, reason string) {
+	_, ok := tracker.RemoveFile(name)
+	if !ok {
+		return
+	}
+	err := os.Remove(godPath(name))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		log.Println(name, "删除元数据文件失败：", err)
+	}
+	handles.evict(filePath(name))
+	log.Println(name, reason)
+	notifySeeders(name, protocol.TypeRemove)
+}
+
+// 清空文件的swarm，并通知原来拥有此文件的客户端
+func notifySeeders(fileName string, t protocol.Type) {
+	for _, cli := range tracker.ResetSwarm(fileName) {
+		if err := cli.send(t, protocol.File{FileName: fileName}); err != nil {
+			log.Println("通知客户端", cli.ID, "失败：", err)
+		}
+	}
+}